@@ -0,0 +1,188 @@
+// Command eval measures how often noisy excerpts of a set of songs are
+// matched back to the right song, once per STFT window, so windows can be
+// compared on the same material.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+
+	"shazam-go/internal/audio"
+	"shazam-go/internal/fingerprint"
+	"shazam-go/internal/matcher"
+	"shazam-go/internal/window"
+)
+
+// song is an audio file decoded to mono at the preset's sample rate.
+type song struct {
+	path    string
+	samples []float64
+}
+
+// clip is one query: an excerpt of a song with noise mixed in. The same
+// clips are used for every window.
+type clip struct {
+	song    int // index into the loaded songs
+	samples []float64
+}
+
+// result is the outcome of querying every clip against one window's database.
+type result struct {
+	window  string
+	matched int
+	total   int
+}
+
+func main() {
+	presetFlag := flag.String("preset", fingerprint.DefaultPreset, "Fingerprint preset ("+strings.Join(fingerprint.PresetNames(), ", ")+")")
+	windowsFlag := flag.String("windows", strings.Join(window.Names(), ","), "Comma-separated STFT windows to compare; use kaiser:<beta> to set the Kaiser beta")
+	clipsFlag := flag.Int("clips", 10, "Number of excerpts to query per song")
+	lengthFlag := flag.Float64("length", 5, "Excerpt length in seconds")
+	snrFlag := flag.Float64("snr", 10, "Signal-to-noise ratio of the excerpts in dB")
+	seedFlag := flag.Int64("seed", 1, "Seed for choosing excerpts and noise")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Usage:")
+		fmt.Println("  go run cmd/eval/main.go [--windows hann,hamming] [--clips 10] [--length 5] [--snr 10] <audio_file>...")
+		flag.PrintDefaults()
+		return
+	}
+
+	if *clipsFlag < 1 || *lengthFlag <= 0 {
+		fmt.Println("Error: --clips and --length must be positive")
+		return
+	}
+	base, err := fingerprint.Preset(*presetFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	var songs []song
+	for _, path := range flag.Args() {
+		samples, err := loadSong(path, base.SampleRate)
+		if err != nil {
+			fmt.Printf("Error loading %s: %v\n", path, err)
+			return
+		}
+		songs = append(songs, song{path: path, samples: samples})
+	}
+	rng := rand.New(rand.NewSource(*seedFlag))
+	clips, err := makeClips(rng, songs, *clipsFlag, int(*lengthFlag*float64(base.SampleRate)), *snrFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var results []result
+	for _, value := range strings.Split(*windowsFlag, ",") {
+		cfg := base
+		cfg.Window, cfg.KaiserBeta, err = window.Parse(strings.TrimSpace(value))
+		if err == nil {
+			err = cfg.Validate()
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		res, err := evaluate(cfg, songs, clips)
+		if err != nil {
+			fmt.Printf("Error evaluating window %s: %v\n", value, err)
+			return
+		}
+		res.window = strings.TrimSpace(value)
+		results = append(results, res)
+	}
+
+	fmt.Printf("\n=== Match rate (%d songs, %d excerpts of %.1fs at %.0f dB SNR, preset %q) ===\n",
+		len(songs), len(clips), *lengthFlag, *snrFlag, base.Name)
+	for _, res := range results {
+		fmt.Printf("  %-20s %4d/%-4d %6.1f%%\n", res.window, res.matched, res.total, 100*float64(res.matched)/float64(res.total))
+	}
+}
+
+// loadSong decodes the audio file at path to mono at sampleRate.
+func loadSong(path string, sampleRate int) ([]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	samples, _, err := audio.LoadWithOptions(file, audio.Options{SampleRate: sampleRate})
+	return samples, err
+}
+
+// makeClips cuts perSong excerpts of length samples at random offsets from
+// each song and adds white noise at snrDB below the excerpt's power.
+func makeClips(rng *rand.Rand, songs []song, perSong, length int, snrDB float64) ([]clip, error) {
+	var clips []clip
+	for i, s := range songs {
+		if len(s.samples) < length {
+			return nil, fmt.Errorf("%s is shorter than the %d-sample excerpt length", s.path, length)
+		}
+		for j := 0; j < perSong; j++ {
+			start := rng.Intn(len(s.samples) - length + 1)
+			excerpt := append([]float64(nil), s.samples[start:start+length]...)
+			power := 0.0
+			for _, x := range excerpt {
+				power += x * x
+			}
+			power /= float64(length)
+			noise := math.Sqrt(power / math.Pow(10, snrDB/10))
+			for k := range excerpt {
+				excerpt[k] += noise * rng.NormFloat64()
+			}
+			clips = append(clips, clip{song: i, samples: excerpt})
+		}
+	}
+	return clips, nil
+}
+
+// evaluate fingerprints the songs into an in-memory database with cfg and
+// counts the clips that match their own song.
+func evaluate(cfg fingerprint.Config, songs []song, clips []clip) (result, error) {
+	db, err := matcher.NewDBWithStore(matcher.NewMemoryStore())
+	if err != nil {
+		return result{}, err
+	}
+	defer db.Close()
+	if err := db.SetConfig(cfg); err != nil {
+		return result{}, err
+	}
+	for i, s := range songs {
+		hashes, err := fingerprintSamples(s.samples, cfg)
+		if err != nil {
+			return result{}, err
+		}
+		if err := db.RegisterSong(matcher.Song{ID: i + 1, SourcePath: s.path}, hashes); err != nil {
+			return result{}, err
+		}
+	}
+	res := result{total: len(clips)}
+	for _, c := range clips {
+		hashes, err := fingerprintSamples(c.samples, cfg)
+		if err != nil {
+			return result{}, err
+		}
+		if db.Match(hashes).SongID == c.song+1 {
+			res.matched++
+		}
+	}
+	return res, nil
+}
+
+func fingerprintSamples(samples []float64, cfg fingerprint.Config) ([]fingerprint.Hash, error) {
+	spectrogram, err := fingerprint.GenerateSpectogram(samples, cfg)
+	if err != nil {
+		return nil, err
+	}
+	peaks, err := fingerprint.ExtractPeaks(spectrogram, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return fingerprint.GenerateHashes(peaks, cfg)
+}
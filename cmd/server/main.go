@@ -1,16 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"shazam-go/internal/audio"
 	"shazam-go/internal/fingerprint"
@@ -27,18 +23,45 @@ type matchResponse struct {
 	Confidence  float64 `json:"confidence,omitempty"`
 	MatchCount  int     `json:"matchCount,omitempty"`
 	TotalHashes int     `json:"totalHashes,omitempty"`
+	// Song is everything recorded about the matched song
+	Song *matcher.Song `json:"song,omitempty"`
 }
 
 type addResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	SongID  int    `json:"songId,omitempty"`
-	SongName string `json:"songName,omitempty"`
+	Success  bool          `json:"success"`
+	Message  string        `json:"message"`
+	SongID   int           `json:"songId,omitempty"`
+	SongName string        `json:"songName,omitempty"`
+	Song     *matcher.Song `json:"song,omitempty"`
 }
 
 func main() {
+	dbFlag := flag.String("db", "", "Database directory (default \""+matcher.DefaultDataDir+"\" in the working directory); must exist unless --create is given")
+	createFlag := flag.Bool("create", false, "Create the --db directory if it doesn't exist, for a server that starts with an empty database")
+	storeFlag := flag.String("store", "", "Storage backend ("+matcher.BackendFile+", "+matcher.BackendBolt+" or "+matcher.BackendIndex+"); defaults to the one the database directory already uses, else "+matcher.BackendFile)
+	presetFlag := flag.String("preset", "", "Fingerprint preset ("+strings.Join(fingerprint.PresetNames(), ", ")+"); defaults to the one the database was built with")
+	flag.Parse()
+
 	fmt.Println("Starting Shazam-Go HTTP server on :8080")
-	db = matcher.NewDB()
+	var err error
+	db, err = matcher.NewDB(matcher.Options{DataDir: *dbFlag, Create: *createFlag, Backend: *storeFlag})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer db.Close()
+	if *presetFlag != "" {
+		cfg, err := fingerprint.Preset(*presetFlag)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if err := db.SetConfig(cfg); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	fmt.Printf("Using fingerprint config %q\n", db.Config().Name)
 
 	http.HandleFunc("/api/match", handleMatch)
 	http.HandleFunc("/api/add", handleAdd)
@@ -65,56 +88,46 @@ func handleAdd(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Save to temp file
-	tmpDir := os.TempDir()
-	tmpPath := filepath.Join(tmpDir, fmt.Sprintf("upload-%d-%s", time.Now().UnixNano(), filepath.Base(header.Filename)))
-	out, err := os.Create(tmpPath)
-	if err != nil {
-		writeAddError(w, fmt.Sprintf("failed to create temp file: %v", err))
-		return
+	// Describe the song before decoding consumes the upload. Form fields
+	// take precedence over the file's tags.
+	song := matcher.Song{
+		Title:      r.FormValue("title"),
+		Artist:     r.FormValue("artist"),
+		Album:      r.FormValue("album"),
+		ISRC:       r.FormValue("isrc"),
+		SourcePath: header.Filename,
 	}
-	_, err = io.Copy(out, file)
-	out.Close()
+	meta, err := audio.ReadMetadata(file)
 	if err != nil {
-		writeAddError(w, fmt.Sprintf("failed to save temp file: %v", err))
+		writeAddError(w, fmt.Sprintf("failed to read file: %v", err))
 		return
 	}
-	defer os.Remove(tmpPath)
-
-	// Convert to WAV if needed
-	fmt.Printf("Converting audio file: %s\n", tmpPath)
-	wavPath, err := convertToWav(tmpPath)
-	if err != nil {
-		fmt.Printf("Conversion error: %v\n", err)
-		writeAddError(w, fmt.Sprintf("failed to convert audio to WAV: %v", err))
+	setIfEmpty(&song.Title, meta.Title)
+	setIfEmpty(&song.Artist, meta.Artist)
+	setIfEmpty(&song.Album, meta.Album)
+	setIfEmpty(&song.ISRC, meta.ISRC)
+	song.Duration = meta.Duration
+	song.SampleRate = meta.SampleRate
+	if song.Checksum, err = audio.Checksum(file); err != nil {
+		writeAddError(w, fmt.Sprintf("failed to read file: %v", err))
 		return
 	}
-	fmt.Printf("Conversion successful, WAV file: %s\n", wavPath)
-	if wavPath != tmpPath {
-		defer os.Remove(wavPath)
-	}
 
 	// Process audio
-	samples, sampleRate, err := audio.LoadWav(wavPath)
+	cfg := db.Config()
+	stream, err := audio.OpenStream(file, audio.Options{SampleRate: cfg.SampleRate})
 	if err != nil {
-		writeAddError(w, fmt.Sprintf("failed to load WAV: %v", err))
+		writeAddError(w, fmt.Sprintf("failed to load audio: %v", err))
 		return
 	}
 
-	monoSamples := samples
-	spectrogram, err := fingerprint.GenerateSpectogram(monoSamples, sampleRate)
-	if err != nil {
-		writeAddError(w, fmt.Sprintf("failed to generate spectrogram: %v", err))
-		return
-	}
-
-	peaks, err := fingerprint.ExtractPeaks(spectrogram, sampleRate)
+	peaks, err := fingerprint.PeaksFromStream(stream, cfg)
 	if err != nil {
 		writeAddError(w, fmt.Sprintf("failed to extract peaks: %v", err))
 		return
 	}
 
-	hashes, err := fingerprint.GenerateHashes(peaks, sampleRate)
+	hashes, err := fingerprint.GenerateHashes(peaks, cfg)
 	if err != nil {
 		writeAddError(w, fmt.Sprintf("failed to generate hashes: %v", err))
 		return
@@ -125,19 +138,22 @@ func handleAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	songName := filepath.Base(header.Filename)
-	songID := generateSongID(songName)
+	song.ID = generateSongID(filepath.Base(header.Filename))
 
-	if err := db.RegisterSong(songID, songName, hashes); err != nil {
+	if err := db.RegisterSong(song, hashes); err != nil {
 		writeAddError(w, fmt.Sprintf("failed to register song: %v", err))
 		return
 	}
+	if stored, ok := db.GetSong(song.ID); ok {
+		song = stored
+	}
 
 	resp := addResponse{
 		Success:  true,
 		Message:  "song added successfully",
-		SongID:   songID,
-		SongName: songName,
+		SongID:   song.ID,
+		SongName: song.Name(),
+		Song:     &song,
 	}
 	writeJSON(w, resp)
 }
@@ -148,61 +164,27 @@ func handleMatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	file, _, err := r.FormFile("file")
 	if err != nil {
 		writeMatchError(w, fmt.Sprintf("failed to read file: %v", err))
 		return
 	}
 	defer file.Close()
 
-	tmpDir := os.TempDir()
-	tmpPath := filepath.Join(tmpDir, fmt.Sprintf("upload-%d-%s", time.Now().UnixNano(), filepath.Base(header.Filename)))
-	out, err := os.Create(tmpPath)
-	if err != nil {
-		writeMatchError(w, fmt.Sprintf("failed to create temp file: %v", err))
-		return
-	}
-	_, err = io.Copy(out, file)
-	out.Close()
-	if err != nil {
-		writeMatchError(w, fmt.Sprintf("failed to save temp file: %v", err))
-		return
-	}
-	defer os.Remove(tmpPath)
-
-	// Convert to WAV if needed
-	fmt.Printf("Converting audio file for matching: %s\n", tmpPath)
-	wavPath, err := convertToWav(tmpPath)
-	if err != nil {
-		fmt.Printf("Conversion error: %v\n", err)
-		writeMatchError(w, fmt.Sprintf("failed to convert audio to WAV: %v", err))
-		return
-	}
-	fmt.Printf("Conversion successful, WAV file: %s\n", wavPath)
-	if wavPath != tmpPath {
-		defer os.Remove(wavPath)
-	}
-
-	samples, sampleRate, err := audio.LoadWav(wavPath)
-	if err != nil {
-		writeMatchError(w, fmt.Sprintf("failed to load WAV: %v", err))
-		return
-	}
-
-	monoSamples := samples
-	spectrogram, err := fingerprint.GenerateSpectogram(monoSamples, sampleRate)
+	cfg := db.Config()
+	stream, err := audio.OpenStream(file, audio.Options{SampleRate: cfg.SampleRate})
 	if err != nil {
-		writeMatchError(w, fmt.Sprintf("failed to generate spectrogram: %v", err))
+		writeMatchError(w, fmt.Sprintf("failed to load audio: %v", err))
 		return
 	}
 
-	peaks, err := fingerprint.ExtractPeaks(spectrogram, sampleRate)
+	peaks, err := fingerprint.PeaksFromStream(stream, cfg)
 	if err != nil {
 		writeMatchError(w, fmt.Sprintf("failed to extract peaks: %v", err))
 		return
 	}
 
-	hashes, err := fingerprint.GenerateHashes(peaks, sampleRate)
+	hashes, err := fingerprint.GenerateHashes(peaks, cfg)
 	if err != nil {
 		writeMatchError(w, fmt.Sprintf("failed to generate hashes: %v", err))
 		return
@@ -232,6 +214,7 @@ func handleMatch(w http.ResponseWriter, r *http.Request) {
 		Message:     "match found",
 		SongID:      result.SongID,
 		SongName:    result.SongName,
+		Song:        &result.Song,
 		Confidence:  result.Confidence,
 		MatchCount:  result.MatchCount,
 		TotalHashes: result.TotalHashes,
@@ -262,6 +245,12 @@ func writeAddError(w http.ResponseWriter, msg string) {
 	writeJSON(w, resp)
 }
 
+func setIfEmpty(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
 // generateSongID generates a stable positive song ID from a filename
 // Same logic as in cmd/shazam/main.go to keep IDs consistent
 func generateSongID(filePath string) int {
@@ -275,123 +264,3 @@ func generateSongID(filePath string) int {
 	}
 	return result
 }
-
-// detectAudioFormat detects the actual audio format by reading file header
-func detectAudioFormat(filePath string) string {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "unknown"
-	}
-	defer file.Close()
-	
-	header := make([]byte, 12)
-	if n, _ := file.Read(header); n < 12 {
-		return "unknown"
-	}
-	
-	// Check for WAV (RIFF...WAVE)
-	if string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE" {
-		return "wav"
-	}
-	// Check for WebM (starts with 0x1A 0x45 0xDF 0xA3)
-	if header[0] == 0x1A && header[1] == 0x45 && header[2] == 0xDF && header[3] == 0xA3 {
-		return "webm"
-	}
-	// Check for MP4/M4A (ftyp box)
-	if string(header[4:8]) == "ftyp" {
-		return "mp4"
-	}
-	// Check for OGG
-	if string(header[0:4]) == "OggS" {
-		return "ogg"
-	}
-	
-	return "unknown"
-}
-
-// convertToWav converts an audio file to WAV format
-// Returns the WAV file path (may be same as input if already WAV)
-// Uses FFmpeg if available, otherwise tries to load directly as WAV
-func convertToWav(inputPath string) (string, error) {
-	ext := strings.ToLower(filepath.Ext(inputPath))
-	
-	// If already WAV, try to load directly
-	if ext == ".wav" {
-		// Verify it's actually a valid WAV file
-		if _, _, err := audio.LoadWav(inputPath); err == nil {
-			return inputPath, nil
-		} else {
-			// If loading failed, detect actual format
-			actualFormat := detectAudioFormat(inputPath)
-			if actualFormat != "wav" {
-				fmt.Printf("File has .wav extension but is actually %s format\n", actualFormat)
-				ext = "." + actualFormat
-			} else {
-				fmt.Printf("Warning: WAV file failed to load, attempting conversion: %v\n", err)
-			}
-		}
-	}
-	
-	// If no extension or unknown format, try to load as WAV first
-	if ext == "" || ext == ".tmp" || ext == ".unknown" {
-		fmt.Printf("Trying to detect format and load as WAV\n")
-		if _, _, err := audio.LoadWav(inputPath); err == nil {
-			return inputPath, nil
-		}
-		// Detect actual format
-		actualFormat := detectAudioFormat(inputPath)
-		if actualFormat != "unknown" && actualFormat != "wav" {
-			ext = "." + actualFormat
-			fmt.Printf("Detected format: %s\n", actualFormat)
-		}
-	}
-	
-	// Check if FFmpeg is available
-	if !isFFmpegAvailable() {
-		if ext == ".wav" || ext == "" {
-			// File claims to be WAV but isn't, or no extension
-			actualFormat := detectAudioFormat(inputPath)
-			if actualFormat != "wav" && actualFormat != "unknown" {
-				return "", fmt.Errorf("file is %s format (not WAV) and requires FFmpeg for conversion. FFmpeg is not installed. Please install FFmpeg from https://ffmpeg.org/download.html", actualFormat)
-			}
-			return "", fmt.Errorf("file appears to be WAV but failed to load. FFmpeg is not installed. Please install FFmpeg from https://ffmpeg.org/download.html or ensure the file is a valid WAV file")
-		}
-		return "", fmt.Errorf("audio format '%s' requires FFmpeg for conversion, but FFmpeg is not installed. Please install FFmpeg from https://ffmpeg.org/download.html or use WAV files", ext)
-	}
-	
-	// Convert using FFmpeg
-	outputPath := inputPath + ".wav"
-	cmd := exec.Command("ffmpeg", "-i", inputPath, "-acodec", "pcm_s16le", "-ar", "44100", "-ac", "1", "-y", outputPath)
-	
-	// Capture stderr to see FFmpeg errors
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	cmd.Stdout = nil
-	
-	if err := cmd.Run(); err != nil {
-		// Include FFmpeg error message in our error
-		ffmpegError := strings.TrimSpace(stderr.String())
-		if ffmpegError != "" {
-			return "", fmt.Errorf("FFmpeg conversion failed: %v\nFFmpeg output: %s", err, ffmpegError)
-		}
-		return "", fmt.Errorf("FFmpeg conversion failed: %v", err)
-	}
-	
-	// Verify output file was created
-	if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("FFmpeg conversion completed but output file was not created: %s", outputPath)
-	}
-	
-	return outputPath, nil
-}
-
-// isFFmpegAvailable checks if FFmpeg is installed and available
-func isFFmpegAvailable() bool {
-	cmd := exec.Command("ffmpeg", "-version")
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	return cmd.Run() == nil
-}
-
-
-
@@ -3,46 +3,131 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"shazam-go/internal/audio"
 	"shazam-go/internal/fingerprint"
 	"shazam-go/internal/matcher"
+	"shazam-go/internal/window"
 )
 
 func main() {
 	addFlag := flag.Bool("add", false, "Add a song to the database")
+	dbFlag := flag.String("db", "", "Database directory (default \""+matcher.DefaultDataDir+"\" in the working directory)")
+	storeFlag := flag.String("store", "", "Storage backend ("+matcher.BackendFile+", "+matcher.BackendBolt+" or "+matcher.BackendIndex+"); defaults to the one the database directory already uses, else "+matcher.BackendFile)
+	channelFlag := flag.Int("channel", 0, "Fingerprint only this channel (1-based); 0 downmixes all channels")
+	downmixFlag := flag.String("downmix", "", "Downmix weights: \"itu51\" or a comma-separated gain per channel")
+	presetFlag := flag.String("preset", "", "Fingerprint preset ("+strings.Join(fingerprint.PresetNames(), ", ")+"); defaults to the one the database was built with")
+	deleteFlag := flag.Int("delete", 0, "Delete the song with this ID from the database")
+	compactFlag := flag.Bool("compact", false, "Drop replaced and deleted songs from the database files")
+	compileFlag := flag.Bool("compile", false, "Compile the database into a read-only index for --store "+matcher.BackendIndex)
+	windowFlag := flag.String("window", "", "STFT window ("+strings.Join(window.Names(), ", ")+"), overriding the preset's; use kaiser:<beta> to set the Kaiser beta")
+	titleFlag := flag.String("title", "", "Song title for --add, overriding the file's tags")
+	artistFlag := flag.String("artist", "", "Artist for --add, overriding the file's tags")
+	albumFlag := flag.String("album", "", "Album for --add, overriding the file's tags")
+	isrcFlag := flag.String("isrc", "", "ISRC for --add, overriding the file's tags")
 	flag.Parse()
 
+	if *deleteFlag != 0 {
+		deleteSong(*dbFlag, *storeFlag, *deleteFlag)
+		return
+	}
+	if *compactFlag {
+		compactDB(*dbFlag, *storeFlag)
+		return
+	}
+	if *compileFlag {
+		compileIndex(*dbFlag, *storeFlag)
+		return
+	}
+
 	if flag.NArg() < 1 {
 		fmt.Println("Usage:")
-		fmt.Println("  Add song:    go run cmd/shazam/main.go --add <path_to_wav_file>")
-		fmt.Println("  Query song:  go run cmd/shazam/main.go <path_to_wav_file>")
+		fmt.Println("  Add song:    go run cmd/shazam/main.go --add [--title <title>] [--artist <artist>] <path_to_audio_file>")
+		fmt.Println("  Query song:  go run cmd/shazam/main.go <path_to_audio_file>")
+		fmt.Println("  Other database:  go run cmd/shazam/main.go --db <dir> [--add] <path_to_audio_file>")
+		fmt.Println("  Delete song:     go run cmd/shazam/main.go [--db <dir>] --delete <song_id>")
+		fmt.Println("  Compact files:   go run cmd/shazam/main.go [--db <dir>] --compact")
+		fmt.Println("  Compile index:   go run cmd/shazam/main.go [--db <dir>] --compile")
+		fmt.Printf("Supported formats: %s\n", strings.Join(audio.Formats(), ", "))
 		flag.PrintDefaults()
 		return
 	}
 
 	filePath := flag.Arg(0)
 
-	// 1. Load WAV
-	samples, sampleRate, err := audio.LoadWav(filePath)
+	// Only adding may create a database; a query against a mistyped --db
+	// path must not silently search an empty one
+	db, err := matcher.NewDB(matcher.Options{DataDir: *dbFlag, Create: *addFlag, Backend: *storeFlag})
 	if err != nil {
-		fmt.Printf("Error loading WAV: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
-	fmt.Printf("Loaded %d samples at %d Hz\n", len(samples), sampleRate)
+	defer db.Close()
 
-	// Samples are already normalized and converted to mono in LoadWav
-	monoSamples := samples
-	// 2. Generate Spectrogram
-	spectrogram, err := fingerprint.GenerateSpectogram(monoSamples, sampleRate)
+	// Queries must be fingerprinted exactly like the songs already in the database
+	cfg := db.Config()
+	if *presetFlag != "" {
+		preset, err := fingerprint.Preset(*presetFlag)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		cfg = preset
+	}
+	if *windowFlag != "" {
+		name, beta, err := window.Parse(*windowFlag)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		cfg.Window, cfg.KaiserBeta = name, beta
+	}
+	if *presetFlag != "" || *windowFlag != "" {
+		if err := db.SetConfig(cfg); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	fmt.Printf("Using fingerprint config %q\n", cfg.Name)
+
+	// 1. Open audio stream (format is detected from the file contents)
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Printf("Error opening file: %v\n", err)
+		return
+	}
+	defer file.Close()
+	var song matcher.Song
+	if *addFlag {
+		// Read before decoding, which consumes the file
+		song = describeSong(file, filePath, matcher.Song{
+			Title:  *titleFlag,
+			Artist: *artistFlag,
+			Album:  *albumFlag,
+			ISRC:   *isrcFlag,
+		})
+	}
+	weights, err := parseDownmixWeights(*downmixFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	stream, err := audio.OpenStream(file, audio.Options{
+		Channel:        *channelFlag,
+		ChannelWeights: weights,
+		SampleRate:     cfg.SampleRate,
+	})
 	if err != nil {
-		fmt.Printf("Error generating spectrogram: %v\n", err)
+		fmt.Printf("Error loading audio: %v\n", err)
 		return
 	}
-	fmt.Printf("Generated spectrogram with %d segments\n", len(spectrogram))
 
-	// 3. Extract Peaks
-	peaks, err := fingerprint.ExtractPeaks(spectrogram, sampleRate)
+	// 2-3. Generate the spectrogram and extract peaks frame by frame,
+	// so memory stays bounded however long the input is
+	peaks, err := fingerprint.PeaksFromStream(stream, cfg)
 	if err != nil {
 		fmt.Printf("Error extracting peaks: %v\n", err)
 		return
@@ -50,18 +135,16 @@ func main() {
 	fmt.Printf("Extracted %d peaks\n", len(peaks))
 
 	// 4. Generate Hashes
-	hashes, err := fingerprint.GenerateHashes(peaks, sampleRate)
+	hashes, err := fingerprint.GenerateHashes(peaks, cfg)
 	if err != nil {
 		fmt.Printf("Error generating hashes: %v\n", err)
 		return
 	}
 	fmt.Printf("Generated %d hashes\n", len(hashes))
 
-	db := matcher.NewDB()
-
 	if *addFlag {
 		// Add song to database
-		addSong(db, filePath, hashes)
+		addSong(db, song, hashes, *dbFlag)
 	} else {
 		// Query/match song
 		result := db.Match(hashes)
@@ -70,6 +153,7 @@ func main() {
 			fmt.Printf("✓ Match found!\n")
 			fmt.Printf("  Song ID: %d\n", result.SongID)
 			fmt.Printf("  Song Name: %s\n", result.SongName)
+			printSongDetails(result.Song)
 			fmt.Printf("  Matches: %d/%d hashes\n", result.MatchCount, result.TotalHashes)
 			fmt.Printf("  Confidence: %.2f%%\n", result.Confidence*100)
 		} else {
@@ -79,37 +163,171 @@ func main() {
 	}
 }
 
-type SongInfo struct{
-	SongID int
-	Title string
-}
-
-func addSong(db *matcher.FingerprintDB, filePath string, hashes map[uint32]float64) {
+func addSong(db *matcher.FingerprintDB, song matcher.Song, hashes []fingerprint.Hash, dataDir string) {
 	fmt.Println("\n=== Adding song to database ===")
-	fmt.Printf("File: %s\n", filePath)
+	fmt.Printf("File: %s\n", song.SourcePath)
 	fmt.Printf("Hashes: %d\n", len(hashes))
 	
-	// Generate a song ID (for now, use a simple hash of the filename)
-	songID := generateSongID(filePath)
-	
-	// Extract just the filename for storage
-	songName := filepath.Base(filePath)
+	// Re-adding a song replaces its old hashes rather than duplicating them
+	if old, ok := db.GetSong(song.ID); ok {
+		fmt.Printf("Replacing existing song %d (%s)\n", song.ID, old.Name())
+	}
 	
-	err := db.RegisterSong(songID, songName, hashes)
+	err := db.RegisterSong(song, hashes)
 	if err != nil {
 		fmt.Printf("Error registering song: %v\n", err)
 		return
 	}
 	
-	// Show database stats
+	// Show what was stored, including the ingest time the database set
+	if stored, ok := db.GetSong(song.ID); ok {
+		song = stored
+	}
 	totalHashes, totalMatches := db.GetStats()
-	fmt.Printf("✓ Successfully added song with ID: %d\n", songID)
-	fmt.Printf("✓ Song name: %s\n", songName)
+	fmt.Printf("✓ Successfully added song with ID: %d\n", song.ID)
+	fmt.Printf("✓ Song name: %s\n", song.Name())
+	printSongDetails(song)
 	fmt.Printf("Database stats: %d unique hashes, %d total matches\n", totalHashes, totalMatches)
-	fmt.Printf("✓ Data saved to disk (data/hashes.db and data/songs.json)\n")
+	if dataDir == "" {
+		dataDir = matcher.DefaultDataDir
+	}
+	fmt.Printf("✓ Data saved to disk (%s)\n", dataDir)
 }
 
+// describeSong gathers what is known about the song in file: its tags and
+// format, checksum and path. Fields set in flags take precedence over tags.
+func describeSong(file *os.File, filePath string, flags matcher.Song) matcher.Song {
+	song := flags
+	// Generate a song ID (for now, use a simple hash of the filename)
+	song.ID = generateSongID(filePath)
+	song.SourcePath = filePath
+	if abs, err := filepath.Abs(filePath); err == nil {
+		song.SourcePath = abs
+	}
+	
+	meta, err := audio.ReadMetadata(file)
+	if err != nil {
+		fmt.Printf("Warning: Could not read tags: %v\n", err)
+	}
+	setIfEmpty(&song.Title, meta.Title)
+	setIfEmpty(&song.Artist, meta.Artist)
+	setIfEmpty(&song.Album, meta.Album)
+	setIfEmpty(&song.ISRC, meta.ISRC)
+	song.Duration = meta.Duration
+	song.SampleRate = meta.SampleRate
+	
+	if song.Checksum, err = audio.Checksum(file); err != nil {
+		fmt.Printf("Warning: Could not checksum file: %v\n", err)
+	}
+	return song
+}
 
+func setIfEmpty(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// printSongDetails prints the recorded metadata of a song, skipping unknown fields
+func printSongDetails(song matcher.Song) {
+	if song.Artist != "" {
+		fmt.Printf("  Artist: %s\n", song.Artist)
+	}
+	if song.Album != "" {
+		fmt.Printf("  Album: %s\n", song.Album)
+	}
+	if song.ISRC != "" {
+		fmt.Printf("  ISRC: %s\n", song.ISRC)
+	}
+	if song.Duration > 0 {
+		fmt.Printf("  Duration: %.1fs\n", song.Duration)
+	}
+	if song.SampleRate > 0 {
+		fmt.Printf("  Sample rate: %d Hz\n", song.SampleRate)
+	}
+	if song.SourcePath != "" {
+		fmt.Printf("  Source: %s\n", song.SourcePath)
+	}
+	if song.Checksum != "" {
+		fmt.Printf("  SHA-256: %s\n", song.Checksum)
+	}
+	if !song.IngestTime.IsZero() {
+		fmt.Printf("  Added: %s\n", song.IngestTime.Local().Format("2006-01-02 15:04:05"))
+	}
+}
+
+// deleteSong removes a song from the database in dataDir
+func deleteSong(dataDir, backend string, songID int) {
+	db, err := matcher.NewDB(matcher.Options{DataDir: dataDir, Backend: backend})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer db.Close()
+
+	songName := db.GetSongName(songID)
+	if err := db.DeleteSong(songID); err != nil {
+		fmt.Printf("Error deleting song: %v\n", err)
+		return
+	}
+	fmt.Printf("✓ Deleted song %d (%s)\n", songID, songName)
+}
+
+// compactDB rewrites the database files in dataDir without dead records
+func compactDB(dataDir, backend string) {
+	db, err := matcher.NewDB(matcher.Options{DataDir: dataDir, Backend: backend})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer db.Close()
+
+	stats, err := db.Compact()
+	if err != nil {
+		fmt.Printf("Error compacting database: %v\n", err)
+		return
+	}
+	fmt.Printf("✓ Compacted catalog from %d to %d bytes\n", stats.BytesBefore, stats.BytesAfter)
+}
+
+// compileIndex writes the database in dataDir out as a compiled index
+func compileIndex(dataDir, backend string) {
+	db, err := matcher.NewDB(matcher.Options{DataDir: dataDir, Backend: backend})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer db.Close()
+
+	if dataDir == "" {
+		dataDir = matcher.DefaultDataDir
+	}
+	if err := db.CompileIndex(dataDir); err != nil {
+		fmt.Printf("Error compiling index: %v\n", err)
+		return
+	}
+	totalHashes, totalMatches := db.GetStats()
+	fmt.Printf("✓ Compiled %d unique hashes, %d total matches into %s\n", totalHashes, totalMatches, dataDir)
+}
+
+// parseDownmixWeights parses the --downmix flag
+func parseDownmixWeights(value string) ([]float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if strings.EqualFold(value, "itu51") {
+		return audio.ITU51Weights, nil
+	}
+	var weights []float64
+	for _, field := range strings.Split(value, ",") {
+		w, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid downmix weight %q", field)
+		}
+		weights = append(weights, w)
+	}
+	return weights, nil
+}
 
 func generateSongID(filePath string) int {
 	// Simple hash function to generate a song ID from filename
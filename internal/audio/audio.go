@@ -1,82 +1,312 @@
 package audio
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"github.com/go-audio/wav"
 )
 
-func LoadWav(path string) ([]float64,int,error) {
+// WAV format tags (wFormatTag in the fmt chunk)
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// wavChunkFrames is the number of sample frames returned per ReadPCM call.
+const wavChunkFrames = 4096
+
+// wavFormat is the part of the fmt chunk needed to interpret sample data.
+// For WAVE_FORMAT_EXTENSIBLE files Tag holds the sub-format, not 0xFFFE.
+type wavFormat struct {
+	Tag         uint16
+	Channels    int
+	SampleRate  int
+	BitDepth    int
+	ChannelMask uint32
+}
+
+// wavCodec is the registered decoder for RIFF/WAVE files.
+type wavCodec struct{}
+
+func (wavCodec) Decode(r io.Reader) (*Buffer, error) {
+	return decodeWav(r)
+}
+
+func (wavCodec) DecodeStream(r io.Reader) (PCMReader, error) {
+	return newWavReader(r)
+}
+
+func init() {
+	RegisterFormat("wav", "RIFF????WAVE", wavCodec{})
+}
+
+func LoadWav(path string) ([]float64, int, error) {
 	fmt.Println("audio: Loading WAV file...")
-	file,err:=os.Open(path)
-	if err!=nil{
-		return nil,0,err
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer file.Close()
 
-	decoder:=wav.NewDecoder(file)
-	if !decoder.IsValidFile() {
-		return nil, 0, fmt.Errorf("invalid WAV file")
+	buf, err := decodeWav(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf.Mono(), buf.SampleRate, nil
+}
+
+// decodeWav decodes a whole WAV stream into a normalized, interleaved Buffer
+func decodeWav(r io.Reader) (*Buffer, error) {
+	reader, err := newWavReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return readAllPCM(reader)
+}
+
+// wavReader decodes the data chunk of a WAV stream incrementally. It never
+// seeks, so it works on pipes and network bodies as well as files.
+type wavReader struct {
+	r          io.Reader
+	format     wavFormat
+	sampleSize int
+	remaining  int64 // bytes left in the data chunk, -1 if unknown
+	normalize  func([]byte) float64
+	raw        []byte
+}
+
+func newWavReader(r io.Reader) (*wavReader, error) {
+	format, dataSize, err := readWavHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	normalize, err := sampleNormalizer(format)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("audio: Format - %d channels, %d-bit %s, %d Hz\n", format.Channels, format.BitDepth, formatName(format.Tag), format.SampleRate)
+
+	sampleSize := (format.BitDepth + 7) / 8
+	return &wavReader{
+		r:          r,
+		format:     format,
+		sampleSize: sampleSize,
+		remaining:  dataSize,
+		normalize:  normalize,
+		raw:        make([]byte, wavChunkFrames*sampleSize*format.Channels),
+	}, nil
+}
+
+// ReadPCM returns the next chunk of up to wavChunkFrames sample frames.
+func (w *wavReader) ReadPCM() (*Buffer, error) {
+	frameSize := w.sampleSize * w.format.Channels
+	want := len(w.raw)
+	if w.remaining >= 0 && int64(want) > w.remaining {
+		want = int(w.remaining)
+	}
+	want -= want % frameSize
+	if want == 0 {
+		return nil, io.EOF
+	}
+
+	n, err := io.ReadFull(w.r, w.raw[:want])
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// Truncated data chunk: keep the complete frames we got
+		w.remaining = 0
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n -= n % frameSize
+	if n == 0 {
+		return nil, io.EOF
+	}
+	if w.remaining > 0 {
+		w.remaining -= int64(n)
+	}
+
+	data := make([]float64, n/w.sampleSize)
+	for i := range data {
+		data[i] = w.normalize(w.raw[i*w.sampleSize : (i+1)*w.sampleSize])
 	}
+	return &Buffer{
+		Data:       data,
+		Channels:   w.format.Channels,
+		SampleRate: w.format.SampleRate,
+		BitDepth:   w.format.BitDepth,
+	}, nil
+}
 
-	buf,err:=decoder.FullPCMBuffer()
-	if err!=nil{
-		return nil,0,err
+// sampleNormalizer returns a function that maps one little-endian sample to
+// [-1.0, 1.0] according to the sample format and container bit depth.
+func sampleNormalizer(format wavFormat) (func([]byte) float64, error) {
+	switch format.Tag {
+	case wavFormatPCM:
+		switch format.BitDepth {
+		case 8:
+			// 8-bit WAV samples are unsigned, centered on 128
+			return func(b []byte) float64 { return (float64(b[0]) - 128) / 128.0 }, nil
+		case 16:
+			return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / 32768.0 }, nil
+		case 24:
+			return func(b []byte) float64 {
+				v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+				return float64(v) / 8388608.0
+			}, nil
+		case 32:
+			return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648.0 }, nil
+		}
+	case wavFormatIEEEFloat:
+		switch format.BitDepth {
+		case 32:
+			return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }, nil
+		case 64:
+			return func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported WAV format tag 0x%04X", format.Tag)
 	}
+	return nil, fmt.Errorf("unsupported %d-bit %s WAV", format.BitDepth, formatName(format.Tag))
+}
 
-	sampleRate:=int(decoder.SampleRate)
-	format := buf.Format
-	numChannels:=int(format.NumChannels)
-	maxAbsValue:=0
-	for _, sample:=range buf.Data {
-		abs:=sample
-		if abs<0 {
-			abs=-abs
+func formatName(tag uint16) string {
+	if tag == wavFormatIEEEFloat {
+		return "float"
+	}
+	return "PCM"
+}
+
+// readWavHeader reads the RIFF chunks up to the start of the data chunk and
+// returns the sample format and the data chunk size (-1 if unknown, as
+// written by streaming encoders).
+func readWavHeader(r io.Reader) (wavFormat, int64, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return wavFormat{}, 0, fmt.Errorf("invalid WAV file: %v", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return wavFormat{}, 0, fmt.Errorf("invalid WAV file")
+	}
+
+	var format wavFormat
+	haveFormat := false
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return wavFormat{}, 0, fmt.Errorf("invalid WAV file: missing data chunk")
 		}
-		if abs>maxAbsValue {
-			maxAbsValue=abs
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch string(header[0:4]) {
+		case "fmt ":
+			if size < 16 {
+				return wavFormat{}, 0, fmt.Errorf("invalid WAV file: fmt chunk too short")
+			}
+			chunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return wavFormat{}, 0, err
+			}
+			format = wavFormat{
+				Tag:        binary.LittleEndian.Uint16(chunk[0:2]),
+				Channels:   int(binary.LittleEndian.Uint16(chunk[2:4])),
+				SampleRate: int(binary.LittleEndian.Uint32(chunk[4:8])),
+				BitDepth:   int(binary.LittleEndian.Uint16(chunk[14:16])),
+			}
+			if format.Tag == wavFormatExtensible {
+				// cbSize(2) validBits(2) channelMask(4) subFormat GUID(16)
+				if size < 40 {
+					return wavFormat{}, 0, fmt.Errorf("invalid WAV file: WAVE_FORMAT_EXTENSIBLE fmt chunk too short")
+				}
+				format.ChannelMask = binary.LittleEndian.Uint32(chunk[20:24])
+				// The first two bytes of the sub-format GUID are the format tag
+				format.Tag = binary.LittleEndian.Uint16(chunk[24:26])
+			}
+			if format.Channels < 1 || format.BitDepth < 8 {
+				return wavFormat{}, 0, fmt.Errorf("invalid WAV file: bad fmt chunk")
+			}
+			if err := checkSampleRate(format.SampleRate); err != nil {
+				return wavFormat{}, 0, fmt.Errorf("invalid WAV file: %v", err)
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return wavFormat{}, 0, fmt.Errorf("invalid WAV file: data chunk before fmt chunk")
+			}
+			if size == 0xFFFFFFFF {
+				size = -1
+			}
+			return format, size, nil
+		default:
+			// chunks are word aligned
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return wavFormat{}, 0, fmt.Errorf("invalid WAV file: %v", err)
+			}
 		}
 	}
-	// Infer bit depth from maximum value and calculate normalization factor
-	// For 16-bit: max value is 32767, so divide by 32768.0
-	// For 24-bit: max value is 8388607, so divide by 8388608.0
-	// For 32-bit: max value is 2147483647, so divide by 2147483648.0
-	var maxValue float64
-	var bitDepth int
-	if maxAbsValue <= 127 {
-		bitDepth = 8
-		maxValue = 128.0
-	} else if maxAbsValue <= 32767 {
-		bitDepth = 16
-		maxValue = 32768.0
-	} else if maxAbsValue <= 8388607 {
-		bitDepth = 24
-		maxValue = 8388608.0
-	} else {
-		bitDepth = 32
-		maxValue = 2147483648.0
-	}
-
-	fmt.Printf("audio: Format - %d channels, %d-bit (inferred), %d Hz\n", numChannels, bitDepth, sampleRate)
-	samples:=make([]float64,len(buf.Data))
-	for i,sample:=range buf.Data {
-		// Normalize to [-1.0, 1.0] range
-		samples[i]=float64(sample)/maxValue
-	}
-	// If stereo, convert to mono
-	if numChannels == 2 {
-		samples = ToMono(samples)
-	}
-
-	return samples,sampleRate,nil
 }
 
 func ToMono(stereoSamples []float64) []float64 {
-	monoSamples:=make([]float64,len(stereoSamples)/2)
-	for i:=0;i<len(monoSamples);i++{
-		left:=stereoSamples[i*2]
-		right:=stereoSamples[i*2+1]
-		monoSamples[i]=(left+right)/2.0
+	monoSamples := make([]float64, len(stereoSamples)/2)
+	for i := 0; i < len(monoSamples); i++ {
+		left := stereoSamples[i*2]
+		right := stereoSamples[i*2+1]
+		monoSamples[i] = (left + right) / 2.0
 	}
 	return monoSamples
 }
+
+// ITU51Weights are the ITU-R BS.775 downmix gains for 5.1 audio in WAV/FLAC
+// channel order (L, R, C, LFE, Ls, Rs). The LFE channel is dropped.
+var ITU51Weights = []float64{1, 1, math.Sqrt2 / 2, 0, math.Sqrt2 / 2, math.Sqrt2 / 2}
+
+// Downmix mixes interleaved samples with numChannels channels into mono.
+// weights gives one gain per channel; nil averages all channels equally.
+// The result is divided by the sum of the gains so it stays in [-1.0, 1.0].
+func Downmix(samples []float64, numChannels int, weights []float64) ([]float64, error) {
+	if numChannels < 1 {
+		return nil, fmt.Errorf("invalid channel count %d", numChannels)
+	}
+	if weights == nil {
+		weights = make([]float64, numChannels)
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != numChannels {
+		return nil, fmt.Errorf("got %d downmix weights for %d channels", len(weights), numChannels)
+	}
+	total := 0.0
+	for _, w := range weights {
+		total += math.Abs(w)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("downmix weights are all zero")
+	}
+
+	monoSamples := make([]float64, len(samples)/numChannels)
+	for i := range monoSamples {
+		frame := samples[i*numChannels : (i+1)*numChannels]
+		sum := 0.0
+		for ch, v := range frame {
+			sum += v * weights[ch]
+		}
+		monoSamples[i] = sum / total
+	}
+	return monoSamples, nil
+}
+
+// SelectChannel extracts a single channel (0-based) from interleaved samples.
+func SelectChannel(samples []float64, numChannels, channel int) ([]float64, error) {
+	if channel < 0 || channel >= numChannels {
+		return nil, fmt.Errorf("channel %d out of range for %d-channel audio", channel+1, numChannels)
+	}
+	monoSamples := make([]float64, len(samples)/numChannels)
+	for i := range monoSamples {
+		monoSamples[i] = samples[i*numChannels+channel]
+	}
+	return monoSamples, nil
+}
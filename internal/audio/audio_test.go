@@ -0,0 +1,201 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+// riffChunk returns a RIFF chunk holding data, padded to an even length.
+func riffChunk(id string, data []byte) []byte {
+	b := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// wavFile returns a RIFF/WAVE file made of the given chunks.
+func wavFile(chunks ...[]byte) []byte {
+	body := []byte("WAVE")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// fmtChunk returns a 16-byte fmt chunk body.
+func fmtChunk(tag uint16, channels, sampleRate, bitDepth int) []byte {
+	blockAlign := channels * (bitDepth + 7) / 8
+	b := binary.LittleEndian.AppendUint16(nil, tag)
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+	b = binary.LittleEndian.AppendUint32(b, uint32(sampleRate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(sampleRate*blockAlign))
+	b = binary.LittleEndian.AppendUint16(b, uint16(blockAlign))
+	return binary.LittleEndian.AppendUint16(b, uint16(bitDepth))
+}
+
+// extensibleFmtChunk returns a 40-byte WAVE_FORMAT_EXTENSIBLE fmt chunk
+// body whose sub-format GUID carries subFormat.
+func extensibleFmtChunk(subFormat uint16, channels, sampleRate, bitDepth int, channelMask uint32) []byte {
+	b := fmtChunk(wavFormatExtensible, channels, sampleRate, bitDepth)
+	b = binary.LittleEndian.AppendUint16(b, 22)
+	b = binary.LittleEndian.AppendUint16(b, uint16(bitDepth))
+	b = binary.LittleEndian.AppendUint32(b, channelMask)
+	b = binary.LittleEndian.AppendUint16(b, subFormat)
+	return append(b, "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"...)
+}
+
+// pcm encodes integer samples as little-endian PCM of the given bit depth,
+// offsetting 8-bit samples to unsigned as WAV stores them.
+func pcm(bitDepth int, samples ...int) []byte {
+	var b []byte
+	for _, v := range samples {
+		if bitDepth == 8 {
+			b = append(b, byte(v+128))
+			continue
+		}
+		for i := 0; i < bitDepth/8; i++ {
+			b = append(b, byte(v>>(8*i)))
+		}
+	}
+	return b
+}
+
+func float32s(samples ...float32) []byte {
+	var b []byte
+	for _, v := range samples {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+	}
+	return b
+}
+
+func float64s(samples ...float64) []byte {
+	var b []byte
+	for _, v := range samples {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+func TestDecodeWav(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     []byte
+		channels int
+		bitDepth int
+		mask     uint32
+		want     []float64
+	}{
+		{
+			name:     "8-bit PCM",
+			file:     wavFile(riffChunk("fmt ", fmtChunk(wavFormatPCM, 1, 8000, 8)), riffChunk("data", pcm(8, -128, -64, 0, 64, 127))),
+			channels: 1, bitDepth: 8,
+			want: []float64{-1, -0.5, 0, 0.5, 127.0 / 128},
+		},
+		{
+			name:     "16-bit PCM",
+			file:     wavFile(riffChunk("fmt ", fmtChunk(wavFormatPCM, 2, 8000, 16)), riffChunk("data", pcm(16, -32768, 16384, 0, 32767))),
+			channels: 2, bitDepth: 16,
+			want: []float64{-1, 0.5, 0, 32767.0 / 32768},
+		},
+		{
+			name:     "24-bit PCM",
+			file:     wavFile(riffChunk("fmt ", fmtChunk(wavFormatPCM, 1, 8000, 24)), riffChunk("data", pcm(24, -8388608, -1, 4194304, 8388607))),
+			channels: 1, bitDepth: 24,
+			want: []float64{-1, -1.0 / 8388608, 0.5, 8388607.0 / 8388608},
+		},
+		{
+			name:     "32-bit PCM",
+			file:     wavFile(riffChunk("fmt ", fmtChunk(wavFormatPCM, 1, 8000, 32)), riffChunk("data", pcm(32, math.MinInt32, -1<<29, 1<<30, 0))),
+			channels: 1, bitDepth: 32,
+			want: []float64{-1, -0.25, 0.5, 0},
+		},
+		{
+			name:     "32-bit float",
+			file:     wavFile(riffChunk("fmt ", fmtChunk(wavFormatIEEEFloat, 1, 8000, 32)), riffChunk("data", float32s(-1, 0.25, 0.5))),
+			channels: 1, bitDepth: 32,
+			want: []float64{-1, 0.25, 0.5},
+		},
+		{
+			name:     "64-bit float",
+			file:     wavFile(riffChunk("fmt ", fmtChunk(wavFormatIEEEFloat, 2, 8000, 64)), riffChunk("data", float64s(-0.125, 1, 0.1, -0.7))),
+			channels: 2, bitDepth: 64,
+			want: []float64{-0.125, 1, 0.1, -0.7},
+		},
+		{
+			name:     "extensible 24-bit PCM",
+			file:     wavFile(riffChunk("fmt ", extensibleFmtChunk(wavFormatPCM, 2, 8000, 24, 0x3)), riffChunk("data", pcm(24, 4194304, -4194304))),
+			channels: 2, bitDepth: 24, mask: 0x3,
+			want: []float64{0.5, -0.5},
+		},
+		{
+			name:     "extensible float",
+			file:     wavFile(riffChunk("fmt ", extensibleFmtChunk(wavFormatIEEEFloat, 1, 8000, 32, 0x4)), riffChunk("data", float32s(0.75))),
+			channels: 1, bitDepth: 32, mask: 0x4,
+			want: []float64{0.75},
+		},
+		{
+			// Odd-sized chunks are followed by a pad byte that isn't counted in
+			// their size
+			name: "odd-sized chunks",
+			file: wavFile(riffChunk("LIST", []byte("odd")), riffChunk("fmt ", fmtChunk(wavFormatPCM, 1, 8000, 8)),
+				riffChunk("junk", []byte{1}), riffChunk("data", pcm(8, 64, -64, 0))),
+			channels: 1, bitDepth: 8,
+			want: []float64{0.5, -0.5, 0},
+		},
+	} {
+		r, err := newWavReader(bytes.NewReader(tc.file))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if r.format.ChannelMask != tc.mask {
+			t.Errorf("%s: channel mask %#x, want %#x", tc.name, r.format.ChannelMask, tc.mask)
+		}
+		buf, err := readAllPCM(r)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if buf.Channels != tc.channels || buf.SampleRate != 8000 || buf.BitDepth != tc.bitDepth {
+			t.Errorf("%s: decoded %d channels, %d Hz, %d-bit; want %d, 8000, %d",
+				tc.name, buf.Channels, buf.SampleRate, buf.BitDepth, tc.channels, tc.bitDepth)
+		}
+		if len(buf.Data) != len(tc.want) {
+			t.Errorf("%s: decoded %v, want %v", tc.name, buf.Data, tc.want)
+			continue
+		}
+		for i, v := range buf.Data {
+			if v != tc.want[i] {
+				t.Errorf("%s: decoded %v, want %v", tc.name, buf.Data, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDecodeWavMissingChunks(t *testing.T) {
+	format := riffChunk("fmt ", fmtChunk(wavFormatPCM, 1, 8000, 16))
+	data := riffChunk("data", pcm(16, 1, 2))
+	for _, tc := range []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"no fmt chunk", wavFile(data), "data chunk before fmt chunk"},
+		{"no data chunk", wavFile(format), "missing data chunk"},
+		{"no data chunk after others", wavFile(format, riffChunk("LIST", []byte("odd"))), "missing data chunk"},
+		{"short fmt chunk", wavFile(riffChunk("fmt ", fmtChunk(wavFormatPCM, 1, 8000, 16)[:14]), data), "fmt chunk too short"},
+		{"short extensible fmt chunk", wavFile(riffChunk("fmt ", extensibleFmtChunk(wavFormatPCM, 1, 8000, 16, 0)[:24]), data), "too short"},
+		{"not WAVE", append([]byte("RIFF\x04\x00\x00\x00AVI "), format...), "invalid WAV file"},
+	} {
+		_, err := decodeWav(bytes.NewReader(tc.file))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
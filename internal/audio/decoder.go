@@ -0,0 +1,170 @@
+package audio
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrUnknownFormat is returned by Load when no registered format matches the input.
+var ErrUnknownFormat = errors.New("audio: unknown format")
+
+// Buffer holds decoded PCM audio normalized to [-1.0, 1.0].
+// Samples are interleaved by channel, as in a WAV data chunk.
+type Buffer struct {
+	Data       []float64
+	Channels   int
+	SampleRate int
+	BitDepth   int
+}
+
+// Decoder decodes one container format into a Buffer.
+type Decoder interface {
+	Decode(r io.Reader) (*Buffer, error)
+}
+
+// DecoderFunc adapts an ordinary function to the Decoder interface.
+type DecoderFunc func(r io.Reader) (*Buffer, error)
+
+// Decode calls f(r).
+func (f DecoderFunc) Decode(r io.Reader) (*Buffer, error) {
+	return f(r)
+}
+
+type format struct {
+	name    string
+	magic   string
+	decoder Decoder
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   []format
+)
+
+// sniffLen is the number of header bytes examined when matching magic strings.
+const sniffLen = 16
+
+// RegisterFormat registers a decoder for the format whose files start with magic.
+// A '?' in magic matches any byte. Formats are tried in registration order.
+func RegisterFormat(name, magic string, decoder Decoder) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats = append(formats, format{name: name, magic: magic, decoder: decoder})
+}
+
+// Formats returns the names of all registered formats.
+func Formats() []string {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	var names []string
+	for _, f := range formats {
+		if len(names) == 0 || names[len(names)-1] != f.name {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// Options controls how decoded audio is turned into the mono signal that gets fingerprinted.
+type Options struct {
+	// Channel selects a single channel (1-based) to fingerprint on its own.
+	// Zero downmixes all channels.
+	Channel int
+	// ChannelWeights are per-channel downmix gains, e.g. ITU51Weights.
+	// Nil averages all channels equally.
+	ChannelWeights []float64
+	// SampleRate is the rate the output is resampled to.
+	// Zero means DefaultSampleRate.
+	SampleRate int
+}
+
+// Load detects the format of r from its leading bytes, decodes it with the
+// registered decoder, converts the result to mono and resamples it to DefaultSampleRate.
+func Load(r io.Reader) ([]float64, int, error) {
+	return LoadWithOptions(r, Options{})
+}
+
+// LoadWithOptions is like Load but lets the caller choose how channels are
+// mixed down and the output sample rate.
+func LoadWithOptions(r io.Reader, opts Options) ([]float64, int, error) {
+	stream, err := OpenStream(r, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	samples, err := ReadAll(stream)
+	if err != nil {
+		return nil, 0, err
+	}
+	return samples, stream.SampleRate(), nil
+}
+
+// Mono returns the buffer's samples with all channels averaged equally.
+func (b *Buffer) Mono() []float64 {
+	samples, err := b.Mix(Options{})
+	if err != nil {
+		return nil
+	}
+	return samples
+}
+
+// Mix reduces the buffer to a single channel as described by opts.
+func (b *Buffer) Mix(opts Options) ([]float64, error) {
+	if opts.Channel > 0 {
+		return SelectChannel(b.Data, b.Channels, opts.Channel-1)
+	}
+	if b.Channels == 1 && opts.ChannelWeights == nil {
+		return b.Data, nil
+	}
+	if b.Channels == 2 && opts.ChannelWeights == nil {
+		return ToMono(b.Data), nil
+	}
+	return Downmix(b.Data, b.Channels, opts.ChannelWeights)
+}
+
+func matchFormat(header []byte) (format, bool) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	for _, f := range formats {
+		if matchMagic(f.magic, header) {
+			return f, true
+		}
+	}
+	return format{}, false
+}
+
+func matchMagic(magic string, header []byte) bool {
+	if len(magic) > len(header) {
+		return false
+	}
+	for i := 0; i < len(magic); i++ {
+		if magic[i] != '?' && magic[i] != header[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sniff returns the first sniffLen bytes of r without consuming them.
+// Seekable readers are rewound so decoders that need to seek still can.
+func sniff(r io.Reader) (io.Reader, []byte, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		header := make([]byte, sniffLen)
+		n, err := io.ReadFull(rs, header)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, nil, err
+		}
+		if _, err := rs.Seek(-int64(n), io.SeekCurrent); err != nil {
+			return nil, nil, err
+		}
+		return rs, header[:n], nil
+	}
+
+	br := bufio.NewReader(r)
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return br, header, nil
+}
@@ -0,0 +1,118 @@
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Formats without a native decoder are converted to WAV with FFmpeg, if installed.
+func init() {
+	ffmpeg := ffmpegCodec{}
+	RegisterFormat("webm", "\x1A\x45\xDF\xA3", ffmpeg)
+	RegisterFormat("mp4", "????ftyp", ffmpeg)
+	RegisterFormat("ogg", "OggS", ffmpeg)
+	RegisterFormat("mp3", "ID3", ffmpeg)
+	RegisterFormat("mp3", "\xFF\xFB", ffmpeg)
+	RegisterFormat("mp3", "\xFF\xF3", ffmpeg)
+	RegisterFormat("mp3", "\xFF\xF2", ffmpeg)
+}
+
+// ffmpegCodec is the registered decoder for formats converted by FFmpeg.
+type ffmpegCodec struct{}
+
+func (ffmpegCodec) Decode(r io.Reader) (*Buffer, error) {
+	pcm, err := decodeStreamWithFFmpeg(r)
+	if err != nil {
+		return nil, err
+	}
+	return readAllPCM(pcm)
+}
+
+func (ffmpegCodec) DecodeStream(r io.Reader) (PCMReader, error) {
+	return decodeStreamWithFFmpeg(r)
+}
+
+// ffmpegReader streams the WAV file FFmpeg converted the input to, and
+// removes the file once it has been read or reading fails.
+type ffmpegReader struct {
+	*wavReader
+	file *os.File
+}
+
+func (f *ffmpegReader) ReadPCM() (*Buffer, error) {
+	if f.file == nil {
+		return nil, io.EOF
+	}
+	buf, err := f.wavReader.ReadPCM()
+	if err != nil {
+		f.close()
+	}
+	return buf, err
+}
+
+func (f *ffmpegReader) close() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+	f.file = nil
+}
+
+// decodeStreamWithFFmpeg converts r to a 16-bit WAV file using FFmpeg and
+// returns a reader that decodes it incrementally, so memory use doesn't
+// grow with the length of the input. Channel mixing and resampling are left
+// to Load, as for native formats.
+func decodeStreamWithFFmpeg(r io.Reader) (PCMReader, error) {
+	if !isFFmpegAvailable() {
+		return nil, fmt.Errorf("this format requires FFmpeg for conversion, but FFmpeg is not installed. Please install FFmpeg from https://ffmpeg.org/download.html or use WAV or FLAC files")
+	}
+
+	// FFmpeg needs a seekable input for some containers (e.g. MP4), so spool to disk
+	in, err := os.CreateTemp("", "shazam-input-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(in.Name())
+	_, err = io.Copy(in, r)
+	in.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	outputPath := in.Name() + ".wav"
+	cmd := exec.Command("ffmpeg", "-i", in.Name(), "-acodec", "pcm_s16le", "-y", outputPath)
+
+	// Capture stderr to see FFmpeg errors
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(outputPath)
+		ffmpegError := strings.TrimSpace(stderr.String())
+		if ffmpegError != "" {
+			return nil, fmt.Errorf("FFmpeg conversion failed: %v\nFFmpeg output: %s", err, ffmpegError)
+		}
+		return nil, fmt.Errorf("FFmpeg conversion failed: %v", err)
+	}
+
+	out, err := os.Open(outputPath)
+	if err != nil {
+		os.Remove(outputPath)
+		return nil, fmt.Errorf("FFmpeg conversion completed but output file could not be opened: %v", err)
+	}
+	pcm := &ffmpegReader{file: out}
+	if pcm.wavReader, err = newWavReader(out); err != nil {
+		pcm.close()
+		return nil, err
+	}
+	return pcm, nil
+}
+
+// isFFmpegAvailable checks if FFmpeg is installed and available
+func isFFmpegAvailable() bool {
+	cmd := exec.Command("ffmpeg", "-version")
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	return cmd.Run() == nil
+}
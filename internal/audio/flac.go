@@ -0,0 +1,683 @@
+package audio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	flacBlockStreamInfo = 0
+	flacSyncCode        = 0x3FFE
+)
+
+// flacStreamInfo holds the fields of the mandatory STREAMINFO metadata block
+// that the decoder needs.
+type flacStreamInfo struct {
+	SampleRate   int
+	Channels     int
+	BitDepth     int
+	TotalSamples uint64
+}
+
+// flacDecoder decodes a FLAC stream frame by frame.
+type flacDecoder struct {
+	br   *bitReader
+	info flacStreamInfo
+}
+
+// flacCodec is the registered decoder for FLAC streams.
+type flacCodec struct{}
+
+func (flacCodec) Decode(r io.Reader) (*Buffer, error) {
+	return decodeFLAC(r)
+}
+
+func (flacCodec) DecodeStream(r io.Reader) (PCMReader, error) {
+	return newFLACDecoder(r)
+}
+
+func init() {
+	RegisterFormat("flac", "fLaC", flacCodec{})
+}
+
+// LoadFLAC loads a FLAC file, normalizes it to [-1.0, 1.0] and converts it to mono.
+// Sample rate, bit depth and channel count come from the STREAMINFO block.
+func LoadFLAC(path string) ([]float64, int, error) {
+	fmt.Println("audio: Loading FLAC file...")
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	buf, err := decodeFLAC(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf.Mono(), buf.SampleRate, nil
+}
+
+// decodeFLAC decodes a whole FLAC stream into a normalized, interleaved Buffer.
+func decodeFLAC(r io.Reader) (*Buffer, error) {
+	decoder, err := newFLACDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	return readAllPCM(decoder)
+}
+
+// ReadPCM decodes the next frame into a normalized, interleaved Buffer.
+func (d *flacDecoder) ReadPCM() (*Buffer, error) {
+	channels, err := d.nextFrame()
+	if err != nil {
+		return nil, err
+	}
+	info := d.info
+	maxValue := float64(int64(1) << (info.BitDepth - 1))
+	// Interleave channels like a WAV buffer so the same mixing applies
+	samples := make([]float64, 0, len(channels)*len(channels[0]))
+	for i := range channels[0] {
+		for ch := range channels {
+			samples = append(samples, float64(channels[ch][i])/maxValue)
+		}
+	}
+	return &Buffer{
+		Data:       samples,
+		Channels:   len(channels),
+		SampleRate: info.SampleRate,
+		BitDepth:   info.BitDepth,
+	}, nil
+}
+
+// newFLACDecoder checks the "fLaC" marker and reads the metadata blocks,
+// leaving the reader positioned at the first audio frame.
+func newFLACDecoder(r io.Reader) (*flacDecoder, error) {
+	d := &flacDecoder{br: newBitReader(r)}
+
+	magic, err := d.br.readBits(32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FLAC file: %v", err)
+	}
+	if magic != 0x664C6143 { // "fLaC"
+		return nil, fmt.Errorf("invalid FLAC file")
+	}
+
+	haveStreamInfo := false
+	for {
+		last, err := d.br.readBits(1)
+		if err != nil {
+			return nil, err
+		}
+		blockType, err := d.br.readBits(7)
+		if err != nil {
+			return nil, err
+		}
+		length, err := d.br.readBits(24)
+		if err != nil {
+			return nil, err
+		}
+
+		if blockType == flacBlockStreamInfo {
+			if err := d.readStreamInfo(); err != nil {
+				return nil, err
+			}
+			haveStreamInfo = true
+		} else if err := d.br.skipBytes(int(length)); err != nil {
+			return nil, err
+		}
+
+		if last == 1 {
+			break
+		}
+	}
+	if !haveStreamInfo {
+		return nil, fmt.Errorf("invalid FLAC file: missing STREAMINFO block")
+	}
+	fmt.Printf("audio: Format - %d channels, %d-bit, %d Hz\n", d.info.Channels, d.info.BitDepth, d.info.SampleRate)
+	return d, nil
+}
+
+func (d *flacDecoder) readStreamInfo() error {
+	// min/max block size (16+16) and min/max frame size (24+24) are not needed
+	if err := d.br.skipBytes(10); err != nil {
+		return err
+	}
+	sampleRate, err := d.br.readBits(20)
+	if err != nil {
+		return err
+	}
+	channels, err := d.br.readBits(3)
+	if err != nil {
+		return err
+	}
+	bitDepth, err := d.br.readBits(5)
+	if err != nil {
+		return err
+	}
+	totalSamples, err := d.br.readBits(36)
+	if err != nil {
+		return err
+	}
+	// MD5 signature of the unencoded audio
+	if err := d.br.skipBytes(16); err != nil {
+		return err
+	}
+
+	d.info = flacStreamInfo{
+		SampleRate:   int(sampleRate),
+		Channels:     int(channels) + 1,
+		BitDepth:     int(bitDepth) + 1,
+		TotalSamples: totalSamples,
+	}
+	if err := checkSampleRate(d.info.SampleRate); err != nil {
+		return fmt.Errorf("invalid FLAC file: %v", err)
+	}
+	return nil
+}
+
+// nextFrame decodes the next audio frame and returns one slice of samples per
+// channel. It returns io.EOF once the stream is exhausted.
+func (d *flacDecoder) nextFrame() (channels [][]int32, err error) {
+	br := d.br
+	br.resetCRC()
+	sync, err := br.readBits(14)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sync != flacSyncCode {
+		return nil, fmt.Errorf("flac: lost frame sync")
+	}
+	// Past the sync code, running out of input means the frame was cut short
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	// reserved bit + blocking strategy
+	if _, err := br.readBits(2); err != nil {
+		return nil, err
+	}
+	blockSizeCode, err := br.readBits(4)
+	if err != nil {
+		return nil, err
+	}
+	sampleRateCode, err := br.readBits(4)
+	if err != nil {
+		return nil, err
+	}
+	channelAssignment, err := br.readBits(4)
+	if err != nil {
+		return nil, err
+	}
+	sampleSizeCode, err := br.readBits(3)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := br.readBits(1); err != nil {
+		return nil, err
+	}
+	if err := br.skipUTF8(); err != nil {
+		return nil, err
+	}
+
+	blockSize, err := d.frameBlockSize(blockSizeCode)
+	if err != nil {
+		return nil, err
+	}
+	// The frame may carry its own sample rate; we always use STREAMINFO's
+	switch sampleRateCode {
+	case 12:
+		_, err = br.readBits(8)
+	case 13, 14:
+		_, err = br.readBits(16)
+	case 15:
+		err = fmt.Errorf("flac: invalid sample rate code")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bitDepth := d.info.BitDepth
+	switch sampleSizeCode {
+	case 0:
+	case 1:
+		bitDepth = 8
+	case 2:
+		bitDepth = 12
+	case 4:
+		bitDepth = 16
+	case 5:
+		bitDepth = 20
+	case 6:
+		bitDepth = 24
+	case 7:
+		bitDepth = 32
+	default:
+		return nil, fmt.Errorf("flac: invalid sample size code %d", sampleSizeCode)
+	}
+
+	// The header ends byte-aligned with a CRC-8 of everything before it
+	headerCRC := br.crc8
+	if crc, err := br.readBits(8); err != nil {
+		return nil, err
+	} else if uint8(crc) != headerCRC {
+		return nil, fmt.Errorf("flac: frame header CRC mismatch")
+	}
+
+	numChannels := int(channelAssignment) + 1
+	if channelAssignment >= 8 {
+		if channelAssignment > 10 {
+			return nil, fmt.Errorf("flac: invalid channel assignment %d", channelAssignment)
+		}
+		numChannels = 2
+	}
+
+	channels = make([][]int32, numChannels)
+	for ch := range channels {
+		// The side channel of a stereo decorrelated pair needs one extra bit
+		subframeDepth := bitDepth
+		if (channelAssignment == 8 && ch == 1) || (channelAssignment == 9 && ch == 0) || (channelAssignment == 10 && ch == 1) {
+			subframeDepth++
+		}
+		channels[ch], err = d.readSubframe(blockSize, subframeDepth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch channelAssignment {
+	case 8: // left/side
+		for i := range channels[0] {
+			channels[1][i] = channels[0][i] - channels[1][i]
+		}
+	case 9: // side/right
+		for i := range channels[0] {
+			channels[0][i] += channels[1][i]
+		}
+	case 10: // mid/side
+		for i := range channels[0] {
+			side := channels[1][i]
+			mid := channels[0][i]<<1 | side&1
+			channels[0][i] = (mid + side) >> 1
+			channels[1][i] = (mid - side) >> 1
+		}
+	}
+
+	// Frames end byte-aligned, followed by a CRC-16 of the whole frame
+	br.align()
+	frameCRC := br.crc16
+	if crc, err := br.readBits(16); err != nil {
+		return nil, err
+	} else if uint16(crc) != frameCRC {
+		return nil, fmt.Errorf("flac: frame CRC mismatch")
+	}
+	return channels, nil
+}
+
+func (d *flacDecoder) frameBlockSize(code uint64) (int, error) {
+	switch {
+	case code == 1:
+		return 192, nil
+	case code >= 2 && code <= 5:
+		return 576 << (code - 2), nil
+	case code == 6:
+		n, err := d.br.readBits(8)
+		return int(n) + 1, err
+	case code == 7:
+		n, err := d.br.readBits(16)
+		return int(n) + 1, err
+	case code >= 8:
+		return 256 << (code - 8), nil
+	}
+	return 0, fmt.Errorf("flac: invalid block size code %d", code)
+}
+
+func (d *flacDecoder) readSubframe(blockSize, bitDepth int) ([]int32, error) {
+	br := d.br
+	if _, err := br.readBits(1); err != nil {
+		return nil, err
+	}
+	subframeType, err := br.readBits(6)
+	if err != nil {
+		return nil, err
+	}
+	wasted, err := br.readBits(1)
+	if err != nil {
+		return nil, err
+	}
+	wastedBits := 0
+	if wasted == 1 {
+		n, err := br.readUnary()
+		if err != nil {
+			return nil, err
+		}
+		wastedBits = int(n) + 1
+		if wastedBits >= bitDepth {
+			return nil, fmt.Errorf("flac: %d wasted bits in a %d-bit subframe", wastedBits, bitDepth)
+		}
+		bitDepth -= wastedBits
+	}
+
+	samples := make([]int32, blockSize)
+	switch {
+	case subframeType == 0: // constant
+		v, err := br.readSigned(uint(bitDepth))
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = int32(v)
+		}
+	case subframeType == 1: // verbatim
+		for i := range samples {
+			v, err := br.readSigned(uint(bitDepth))
+			if err != nil {
+				return nil, err
+			}
+			samples[i] = int32(v)
+		}
+	case subframeType >= 8 && subframeType <= 12: // fixed predictor
+		if err := d.decodeFixed(samples, int(subframeType-8), bitDepth); err != nil {
+			return nil, err
+		}
+	case subframeType >= 32: // LPC
+		if err := d.decodeLPC(samples, int(subframeType-31), bitDepth); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("flac: reserved subframe type %d", subframeType)
+	}
+
+	if wastedBits > 0 {
+		for i := range samples {
+			samples[i] <<= uint(wastedBits)
+		}
+	}
+	return samples, nil
+}
+
+var flacFixedCoefficients = [][]int64{
+	{},
+	{1},
+	{2, -1},
+	{3, -3, 1},
+	{4, -6, 4, -1},
+}
+
+func (d *flacDecoder) decodeFixed(samples []int32, order, bitDepth int) error {
+	if order > len(samples) {
+		return fmt.Errorf("flac: predictor order %d exceeds block size %d", order, len(samples))
+	}
+	for i := 0; i < order; i++ {
+		v, err := d.br.readSigned(uint(bitDepth))
+		if err != nil {
+			return err
+		}
+		samples[i] = int32(v)
+	}
+	if err := d.readResidual(samples, order); err != nil {
+		return err
+	}
+	predict(samples, flacFixedCoefficients[order], 0)
+	return nil
+}
+
+func (d *flacDecoder) decodeLPC(samples []int32, order, bitDepth int) error {
+	if order > len(samples) {
+		return fmt.Errorf("flac: predictor order %d exceeds block size %d", order, len(samples))
+	}
+	br := d.br
+	for i := 0; i < order; i++ {
+		v, err := br.readSigned(uint(bitDepth))
+		if err != nil {
+			return err
+		}
+		samples[i] = int32(v)
+	}
+	precision, err := br.readBits(4)
+	if err != nil {
+		return err
+	}
+	if precision == 15 {
+		return fmt.Errorf("flac: invalid LPC coefficient precision")
+	}
+	shift, err := br.readSigned(5)
+	if err != nil {
+		return err
+	}
+	if shift < 0 {
+		return fmt.Errorf("flac: negative LPC shift")
+	}
+	coeffs := make([]int64, order)
+	for i := range coeffs {
+		c, err := br.readSigned(uint(precision) + 1)
+		if err != nil {
+			return err
+		}
+		coeffs[i] = c
+	}
+	if err := d.readResidual(samples, order); err != nil {
+		return err
+	}
+	predict(samples, coeffs, uint(shift))
+	return nil
+}
+
+// predict restores samples in place from their residuals, given the
+// warm-up samples already stored in samples[:len(coeffs)].
+func predict(samples []int32, coeffs []int64, shift uint) {
+	order := len(coeffs)
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coeffs {
+			sum += c * int64(samples[i-1-j])
+		}
+		samples[i] += int32(sum >> shift)
+	}
+}
+
+// readResidual reads the Rice-coded residual into samples[order:].
+func (d *flacDecoder) readResidual(samples []int32, order int) error {
+	br := d.br
+	method, err := br.readBits(2)
+	if err != nil {
+		return err
+	}
+	var paramBits uint
+	var escape uint64
+	switch method {
+	case 0:
+		paramBits, escape = 4, 0xF
+	case 1:
+		paramBits, escape = 5, 0x1F
+	default:
+		return fmt.Errorf("flac: reserved residual coding method %d", method)
+	}
+	partitionOrder, err := br.readBits(4)
+	if err != nil {
+		return err
+	}
+
+	partitions := 1 << partitionOrder
+	if len(samples)%partitions != 0 {
+		return fmt.Errorf("flac: block size %d is not divisible into %d residual partitions", len(samples), partitions)
+	}
+	partitionSize := len(samples) >> partitionOrder
+	i := order
+	for p := 0; p < partitions; p++ {
+		n := partitionSize
+		if p == 0 {
+			n -= order
+		}
+		if n < 0 {
+			return fmt.Errorf("flac: invalid residual partition size")
+		}
+		param, err := br.readBits(paramBits)
+		if err != nil {
+			return err
+		}
+		if param == escape {
+			rawBits, err := br.readBits(5)
+			if err != nil {
+				return err
+			}
+			for ; n > 0; n-- {
+				v, err := br.readSigned(uint(rawBits))
+				if err != nil {
+					return err
+				}
+				samples[i] = int32(v)
+				i++
+			}
+			continue
+		}
+		for ; n > 0; n-- {
+			q, err := br.readUnary()
+			if err != nil {
+				return err
+			}
+			r, err := br.readBits(uint(param))
+			if err != nil {
+				return err
+			}
+			u := q<<param | r
+			samples[i] = int32(u>>1) ^ -int32(u&1)
+			i++
+		}
+	}
+	return nil
+}
+
+// bitReader reads big-endian bit fields from a byte stream. It keeps the
+// CRC-8 and CRC-16 of the bytes read since resetCRC, which frames end with.
+type bitReader struct {
+	r     *bufio.Reader
+	cache uint64
+	n     uint
+	crc8  uint8
+	crc16 uint16
+}
+
+// CRC tables for the FLAC frame checksums: CRC-8 with polynomial 0x07 and
+// CRC-16 with polynomial 0x8005, both unreflected and starting at zero
+var flacCRC8Table, flacCRC16Table = makeFLACCRCTables()
+
+func makeFLACCRCTables() (t8 [256]uint8, t16 [256]uint16) {
+	for i := 0; i < 256; i++ {
+		c8 := uint8(i)
+		c16 := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		t8[i], t16[i] = c8, c16
+	}
+	return t8, t16
+}
+
+func newBitReader(r io.Reader) *bitReader {
+	return &bitReader{r: bufio.NewReader(r)}
+}
+
+// readBits reads n (at most 56) bits as an unsigned integer.
+func (b *bitReader) readBits(n uint) (uint64, error) {
+	for b.n < n {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && b.n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.cache = b.cache<<8 | uint64(c)
+		b.n += 8
+		b.crc8 = flacCRC8Table[b.crc8^c]
+		b.crc16 = b.crc16<<8 ^ flacCRC16Table[uint8(b.crc16>>8)^c]
+	}
+	b.n -= n
+	return (b.cache >> b.n) & (1<<n - 1), nil
+}
+
+// readSigned reads an n-bit two's complement integer.
+func (b *bitReader) readSigned(n uint) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := b.readBits(n)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// readUnary counts zero bits up to the next set bit.
+func (b *bitReader) readUnary() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := b.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			return q, nil
+		}
+		q++
+	}
+}
+
+// skipUTF8 skips the UTF-8-style coded frame or sample number in a frame header.
+func (b *bitReader) skipUTF8() error {
+	first, err := b.readBits(8)
+	if err != nil {
+		return err
+	}
+	extra := 0
+	for mask := uint64(0x80); first&mask != 0 && mask > 1; mask >>= 1 {
+		extra++
+	}
+	if extra > 0 {
+		extra--
+	}
+	for ; extra > 0; extra-- {
+		if _, err := b.readBits(8); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetCRC restarts the checksums at the current byte. Bits left over
+// from an earlier byte are not covered.
+func (b *bitReader) resetCRC() {
+	b.crc8, b.crc16 = 0, 0
+}
+
+// align drops any bits left over from a partially consumed byte.
+func (b *bitReader) align() {
+	b.n -= b.n % 8
+}
+
+func (b *bitReader) skipBytes(n int) error {
+	b.align()
+	for ; n > 0 && b.n > 0; n-- {
+		b.n -= 8
+	}
+	_, err := b.r.Discard(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package audio
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/stereo.flac holds fixtureLength samples of 16-bit stereo at
+// 8 kHz in 256-sample frames. The frames cycle through the left/side,
+// side/right, mid/side and independent channel assignments, and the
+// subframes through fixed orders 0-2, LPC and verbatim; the left channel
+// of the last frame is a constant zero.
+const fixtureLength = 2000
+
+func fixtureSample(ch, i int) int {
+	if ch == 0 {
+		if i >= 7*256 {
+			return 0
+		}
+		return (i*i*7+i*131)%4001 - 2000
+	}
+	return (i*53)%1201 - 600
+}
+
+func readFixture(t *testing.T) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "stereo.flac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeFLAC(t *testing.T) {
+	buf, err := decodeFLAC(bytes.NewReader(readFixture(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Channels != 2 || buf.SampleRate != 8000 || buf.BitDepth != 16 {
+		t.Fatalf("decoded %d channels, %d Hz, %d-bit; want 2, 8000, 16", buf.Channels, buf.SampleRate, buf.BitDepth)
+	}
+	if len(buf.Data) != 2*fixtureLength {
+		t.Fatalf("decoded %d samples, want %d", len(buf.Data), 2*fixtureLength)
+	}
+	for i, v := range buf.Data {
+		if want := float64(fixtureSample(i%2, i/2)) / 32768; v != want {
+			t.Fatalf("sample %d of channel %d is %v, want %v", i/2, i%2, v, want)
+		}
+	}
+}
+
+// flacFrame returns a frame of one 1-sample mono subframe for the fixture's
+// STREAMINFO, with the given subframe header byte, a valid header CRC-8
+// and no frame CRC.
+func flacFrame(subframeHeader byte) []byte {
+	// sync, 8-bit block size at the end, mono, frame 0, block size 1
+	frame := []byte{0xff, 0xf8, 0x60, 0x08, 0x00, 0x00}
+	var crc uint8
+	for _, c := range frame {
+		crc = flacCRC8Table[crc^c]
+	}
+	frame = append(frame, crc, subframeHeader)
+	return append(frame, make([]byte, 16)...)
+}
+
+// TestDecodeFLACCorrupt damages the fixture in ways its checksums or
+// sanity checks must catch. Each must fail with an error, not a panic or
+// wrong samples.
+func TestDecodeFLACCorrupt(t *testing.T) {
+	data := readFixture(t)
+	const streamInfoEnd = 4 + 4 + 34 // "fLaC", block header, STREAMINFO
+	flip := func(off int) []byte {
+		corrupt := append([]byte(nil), data...)
+		corrupt[off] ^= 0x10
+		return corrupt
+	}
+	withFrame := func(frame []byte) []byte {
+		return append(append([]byte(nil), data[:streamInfoEnd]...), frame...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"header CRC-8", flip(streamInfoEnd + 7), "header CRC"},
+		{"frame number", flip(streamInfoEnd + 4), "header CRC"},
+		{"frame CRC-16", flip(len(data) - 1), "frame CRC"},
+		{"residual", flip(len(data) / 2), "CRC"},
+		{"fixed order beyond block size", withFrame(flacFrame(12 << 1)), "order 4 exceeds block size 1"},
+		{"LPC order beyond block size", withFrame(flacFrame((32 + 7) << 1)), "order 8 exceeds block size 1"},
+		{"truncated frame", data[:len(data)-100], "unexpected EOF"},
+		{"truncated after a header", data[:streamInfoEnd+7], "unexpected EOF"},
+	} {
+		_, err := decodeFLAC(bytes.NewReader(tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package audio
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Metadata is what an audio file says about itself besides its samples.
+// Fields the file doesn't record are left empty.
+type Metadata struct {
+	Title  string
+	Artist string
+	Album  string
+	ISRC   string
+	// SampleRate is the rate the audio is stored at, before any resampling
+	SampleRate int
+	// Duration is the length of the audio in seconds
+	Duration float64
+}
+
+const (
+	flacBlockVorbisComment = 4
+
+	// maxTagSize bounds how much of a tag chunk is read into memory; larger
+	// chunks (usually embedded pictures) are skipped
+	maxTagSize = 1 << 20
+)
+
+// ReadMetadata reads the tags and audio format of a file without decoding
+// it. It understands WAV (fmt, data, LIST/INFO and id3 chunks), FLAC
+// (STREAMINFO and VORBIS_COMMENT blocks) and files that start with an ID3v2
+// tag, such as MP3s. Other formats, and tags it can't parse, yield empty
+// fields rather than an error. r is returned to where it started.
+func ReadMetadata(r io.ReadSeeker) (Metadata, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return Metadata{}, err
+	}
+	var meta Metadata
+	var magic [4]byte
+	n, err := io.ReadFull(r, magic[:])
+	if err == nil || err == io.ErrUnexpectedEOF {
+		err = nil
+		switch {
+		case string(magic[:]) == "RIFF":
+			err = readWavMetadata(r, &meta)
+		case string(magic[:]) == "fLaC":
+			err = readFLACMetadata(r, &meta)
+		case n >= 3 && string(magic[:3]) == "ID3":
+			var tag []byte
+			if tag, err = readID3Tag(r, magic[:n]); err == nil {
+				parseID3(tag, &meta)
+			}
+		}
+	} else if err == io.EOF {
+		err = nil
+	}
+	if _, seekErr := r.Seek(start, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	return meta, err
+}
+
+// Checksum returns the hex SHA-256 of everything r holds from its current
+// position, and returns r to that position.
+func Checksum(r io.ReadSeeker) (string, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readWavMetadata walks the RIFF chunks after the "RIFF" magic, seeking
+// past the sample data. Tags often follow the data chunk, so unlike
+// readWavHeader it doesn't stop there.
+func readWavMetadata(r io.ReadSeeker, meta *Metadata) error {
+	var riff [8]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[4:8]) != "WAVE" {
+		return nil
+	}
+
+	blockAlign := 0
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil // End of the chunks
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch string(header[0:4]) {
+		case "fmt ":
+			chunk, err := readWavChunk(r, size)
+			if err != nil {
+				return err
+			}
+			if len(chunk) >= 14 {
+				meta.SampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+				blockAlign = int(binary.LittleEndian.Uint16(chunk[12:14]))
+			}
+		case "data":
+			if size == 0xFFFFFFFF {
+				return nil // Streamed with an unknown length; nothing after it can be found
+			}
+			if blockAlign > 0 && meta.SampleRate > 0 {
+				meta.Duration = float64(size/int64(blockAlign)) / float64(meta.SampleRate)
+			}
+			if _, err := r.Seek(size+size%2, io.SeekCurrent); err != nil {
+				return err
+			}
+		case "LIST":
+			chunk, err := readWavChunk(r, size)
+			if err != nil {
+				return err
+			}
+			if len(chunk) >= 4 && string(chunk[:4]) == "INFO" {
+				parseInfoList(chunk[4:], meta)
+			}
+		case "id3 ", "ID3 ":
+			chunk, err := readWavChunk(r, size)
+			if err != nil {
+				return err
+			}
+			if len(chunk) >= 10 && string(chunk[:3]) == "ID3" {
+				parseID3(chunk, meta)
+			}
+		default:
+			if _, err := r.Seek(size+size%2, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readWavChunk reads a RIFF chunk of size bytes and its padding byte.
+func readWavChunk(r io.ReadSeeker, size int64) ([]byte, error) {
+	chunk, err := readTagChunk(r, size+size%2)
+	if int64(len(chunk)) > size {
+		chunk = chunk[:size]
+	}
+	return chunk, err
+}
+
+// readTagChunk reads size bytes, or skips them and returns nil if there are
+// more than maxTagSize. A chunk cut short by the end of the file is
+// returned as far as it goes.
+func readTagChunk(r io.ReadSeeker, size int64) ([]byte, error) {
+	if size > maxTagSize {
+		_, err := r.Seek(size, io.SeekCurrent)
+		return nil, err
+	}
+	chunk := make([]byte, size)
+	n, err := io.ReadFull(r, chunk)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return chunk[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// parseInfoList reads the subchunks of a LIST/INFO chunk.
+func parseInfoList(data []byte, meta *Metadata) {
+	for len(data) >= 8 {
+		id := string(data[:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		data = data[8:]
+		if size > len(data) {
+			size = len(data)
+		}
+		value := cleanTag(string(data[:size]))
+		switch id {
+		case "INAM":
+			setTag(&meta.Title, value)
+		case "IART":
+			setTag(&meta.Artist, value)
+		case "IPRD":
+			setTag(&meta.Album, value)
+		case "ISRC":
+			// Officially "source", the supplier of the file, but some
+			// taggers store the recording code here
+			if isISRC(value) {
+				setTag(&meta.ISRC, value)
+			}
+		}
+		if size%2 == 1 && size < len(data) {
+			size++
+		}
+		data = data[size:]
+	}
+}
+
+// readFLACMetadata reads the metadata blocks after the "fLaC" magic.
+func readFLACMetadata(r io.ReadSeeker, meta *Metadata) error {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		switch blockType {
+		case flacBlockStreamInfo, flacBlockVorbisComment:
+			block, err := readTagChunk(r, length)
+			if err != nil {
+				return err
+			}
+			if blockType == flacBlockStreamInfo {
+				parseFLACStreamInfo(block, meta)
+			} else {
+				parseVorbisComment(block, meta)
+			}
+		default:
+			if _, err := r.Seek(length, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func parseFLACStreamInfo(block []byte, meta *Metadata) {
+	if len(block) < 18 {
+		return
+	}
+	// 20 bits of sample rate, 3 of channels, 5 of bit depth and 36 of
+	// total samples, starting after the block and frame sizes
+	rate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+	total := uint64(block[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(block[14:18]))
+	meta.SampleRate = rate
+	if rate > 0 {
+		meta.Duration = float64(total) / float64(rate)
+	}
+}
+
+// parseVorbisComment reads the KEY=value comments of a VORBIS_COMMENT block.
+// Unlike the rest of FLAC, its lengths are little-endian.
+func parseVorbisComment(block []byte, meta *Metadata) {
+	next := func() (string, bool) {
+		if len(block) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(block)
+		block = block[4:]
+		if uint64(n) > uint64(len(block)) {
+			return "", false
+		}
+		s := string(block[:n])
+		block = block[n:]
+		return s, true
+	}
+	if _, ok := next(); !ok { // Vendor string
+		return
+	}
+	if len(block) < 4 {
+		return
+	}
+	count := binary.LittleEndian.Uint32(block)
+	block = block[4:]
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			return
+		}
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			continue
+		}
+		value = cleanTag(value)
+		switch strings.ToUpper(key) {
+		case "TITLE":
+			setTag(&meta.Title, value)
+		case "ARTIST":
+			setTag(&meta.Artist, value)
+		case "ALBUM":
+			setTag(&meta.Album, value)
+		case "ISRC":
+			setTag(&meta.ISRC, value)
+		}
+	}
+}
+
+// readID3Tag reads the rest of an ID3v2 tag whose first bytes are in
+// prefix, returning the whole tag including its header.
+func readID3Tag(r io.Reader, prefix []byte) ([]byte, error) {
+	header := make([]byte, 10)
+	copy(header, prefix)
+	if _, err := io.ReadFull(r, header[len(prefix):]); err != nil {
+		return nil, nil
+	}
+	size := int64(syncsafe(header[6:10]))
+	if size > maxTagSize {
+		return nil, nil
+	}
+	tag := make([]byte, 10+size)
+	copy(tag, header)
+	n, err := io.ReadFull(r, tag[10:])
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return tag[:10+n], nil
+	}
+	return tag, err
+}
+
+// ID3v2 frames holding the fields of Metadata, for versions 2.2 and 2.3/2.4
+var (
+	id3v22Frames = map[string]string{"TT2": "title", "TP1": "artist", "TAL": "album", "TRC": "isrc", "TLE": "length"}
+	id3v23Frames = map[string]string{"TIT2": "title", "TPE1": "artist", "TALB": "album", "TSRC": "isrc", "TLEN": "length"}
+)
+
+// parseID3 reads the text frames of an ID3v2.2, 2.3 or 2.4 tag.
+func parseID3(tag []byte, meta *Metadata) {
+	if len(tag) < 10 || string(tag[:3]) != "ID3" {
+		return
+	}
+	version, flags := tag[3], tag[5]
+	size := int(syncsafe(tag[6:10]))
+	body := tag[10:]
+	if size < len(body) {
+		body = body[:size]
+	}
+	if flags&0x80 != 0 && version < 4 {
+		// Unsynchronisation of the whole tag; 2.4 does it per frame
+		body = bytes.ReplaceAll(body, []byte{0xFF, 0x00}, []byte{0xFF})
+	}
+
+	idLen, headerLen, frames := 4, 10, id3v23Frames
+	switch version {
+	case 2:
+		idLen, headerLen, frames = 3, 6, id3v22Frames
+	case 3, 4:
+		if flags&0x40 != 0 && len(body) >= 4 {
+			// Skip the extended header
+			n := int(binary.BigEndian.Uint32(body))
+			if version == 4 {
+				n = int(syncsafe(body[:4]))
+			} else {
+				n += 4
+			}
+			if n > len(body) {
+				return
+			}
+			body = body[n:]
+		}
+	default:
+		return
+	}
+
+	for len(body) >= headerLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[4:8]))
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		case 4:
+			frameSize = int(syncsafe(body[4:8]))
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		}
+		body = body[headerLen:]
+		if frameSize > len(body) {
+			return
+		}
+		data := body[:frameSize]
+		body = body[frameSize:]
+
+		field, ok := frames[id]
+		if !ok {
+			continue
+		}
+		switch version {
+		case 3:
+			if frameFlags&0x00C0 != 0 { // Compressed or encrypted
+				continue
+			}
+		case 4:
+			if frameFlags&0x000C != 0 {
+				continue
+			}
+			if frameFlags&0x0001 != 0 { // Data length indicator
+				if len(data) < 4 {
+					continue
+				}
+				data = data[4:]
+			}
+			if frameFlags&0x0002 != 0 {
+				data = bytes.ReplaceAll(data, []byte{0xFF, 0x00}, []byte{0xFF})
+			}
+		}
+
+		value := cleanTag(decodeID3Text(data))
+		switch field {
+		case "title":
+			setTag(&meta.Title, value)
+		case "artist":
+			setTag(&meta.Artist, value)
+		case "album":
+			setTag(&meta.Album, value)
+		case "isrc":
+			setTag(&meta.ISRC, value)
+		case "length":
+			if ms, err := strconv.Atoi(value); err == nil && ms > 0 && meta.Duration == 0 {
+				meta.Duration = float64(ms) / 1000
+			}
+		}
+	}
+}
+
+// decodeID3Text decodes a text frame: an encoding byte followed by the
+// text. Only the first of several NUL-separated values is returned.
+func decodeID3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	encoding, text := data[0], data[1:]
+	switch encoding {
+	case 0: // ISO-8859-1
+		runes := make([]rune, 0, len(text))
+		for _, b := range text {
+			if b == 0 {
+				break
+			}
+			runes = append(runes, rune(b))
+		}
+		return string(runes)
+	case 1, 2: // UTF-16 with a byte order mark, UTF-16BE
+		bigEndian := encoding == 2
+		if len(text) >= 2 && encoding == 1 {
+			bigEndian = text[0] == 0xFE && text[1] == 0xFF
+			if (text[0] == 0xFF && text[1] == 0xFE) || bigEndian {
+				text = text[2:]
+			}
+		}
+		units := make([]uint16, 0, len(text)/2)
+		for i := 0; i+1 < len(text); i += 2 {
+			u := binary.LittleEndian.Uint16(text[i:])
+			if bigEndian {
+				u = binary.BigEndian.Uint16(text[i:])
+			}
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		return string(utf16.Decode(units))
+	case 3: // UTF-8
+		if i := bytes.IndexByte(text, 0); i >= 0 {
+			text = text[:i]
+		}
+		return string(text)
+	}
+	return ""
+}
+
+// syncsafe decodes a 4-byte ID3v2 integer that uses 7 bits per byte.
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// cleanTag strips the NUL padding and surrounding space of a tag value.
+func cleanTag(s string) string {
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// setTag sets a field that isn't set yet, so the first tag found wins.
+func setTag(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// isISRC reports whether s has the form of an ISRC: a country code, a
+// three-character registrant code and seven digits, optionally hyphenated.
+func isISRC(s string) bool {
+	s = strings.ReplaceAll(s, "-", "")
+	if len(s) != 12 {
+		return false
+	}
+	for i := 0; i < 12; i++ {
+		c := s[i]
+		letter := c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+		digit := c >= '0' && c <= '9'
+		switch {
+		case i < 2 && !letter, i < 5 && !letter && !digit, i >= 5 && !digit:
+			return false
+		}
+	}
+	return true
+}
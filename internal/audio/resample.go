@@ -0,0 +1,196 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+
+	"shazam-go/internal/window"
+)
+
+// DefaultSampleRate is the canonical rate audio is fingerprinted at, so that
+// references and queries share the same FFT bin spacing.
+const DefaultSampleRate = 44100
+
+// MaxSampleRate is the highest sample rate accepted from a file or as a
+// resampling target. Sample rates come from file headers, and the
+// resampler's filter grows with the input rate.
+const MaxSampleRate = 768000
+
+const (
+	// resampleZeroCrossings is the number of sinc zero crossings kept on each
+	// side of the filter center at unity cutoff.
+	resampleZeroCrossings = 16
+	// resampleKaiserBeta trades transition width for stopband attenuation (~80 dB).
+	resampleKaiserBeta = 8.0
+	// resampleMaxPhases bounds the polyphase table. Rate pairs with a larger
+	// reduced numerator quantize the fractional position to this many phases.
+	resampleMaxPhases = 1024
+	// resampleMaxHalfTaps bounds the filter length per phase. It is only
+	// reached when downsampling by more than 64x, where the shortened filter
+	// widens the transition band.
+	resampleMaxHalfTaps = 1024
+)
+
+// checkSampleRate rejects sample rates that are zero, negative or beyond
+// MaxSampleRate.
+func checkSampleRate(rate int) error {
+	if rate <= 0 || rate > MaxSampleRate {
+		return fmt.Errorf("unsupported sample rate %d Hz (must be between 1 and %d)", rate, MaxSampleRate)
+	}
+	return nil
+}
+
+// Resample converts mono samples from fromRate to toRate using a band-limited
+// Kaiser-windowed sinc interpolator. When downsampling the cutoff is lowered
+// to the new Nyquist frequency so nothing aliases.
+func Resample(samples []float64, fromRate, toRate int) ([]float64, error) {
+	if err := checkSampleRate(fromRate); err != nil {
+		return nil, err
+	}
+	if err := checkSampleRate(toRate); err != nil {
+		return nil, err
+	}
+	if fromRate == toRate {
+		return samples, nil
+	}
+	r := newResampler(fromRate, toRate)
+	n := int(int64(len(samples)) * int64(r.up) / int64(r.down))
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = r.sample(samples, 0, int64(i))
+	}
+	return out, nil
+}
+
+// resampler holds a polyphase filter bank for converting by up/down.
+// Output sample n sits at input position n*down/up; its integer part picks
+// the input samples and its fractional part picks the filter phase.
+type resampler struct {
+	up, down int
+	halfTaps int
+	phases   [][]float64
+}
+
+func newResampler(fromRate, toRate int) *resampler {
+	g := gcd(fromRate, toRate)
+	r := &resampler{up: toRate / g, down: fromRate / g}
+
+	cutoff := 1.0
+	if toRate < fromRate {
+		cutoff = float64(toRate) / float64(fromRate)
+	}
+	r.halfTaps = int(math.Ceil(resampleZeroCrossings / cutoff))
+	if r.halfTaps > resampleMaxHalfTaps {
+		r.halfTaps = resampleMaxHalfTaps
+	}
+
+	numPhases := r.up
+	if numPhases > resampleMaxPhases {
+		numPhases = resampleMaxPhases
+	}
+	r.phases = make([][]float64, numPhases)
+	for p := range r.phases {
+		frac := float64(p) / float64(numPhases)
+		taps := make([]float64, 2*r.halfTaps)
+		for j := range taps {
+			// tap j multiplies input sample base-halfTaps+1+j
+			d := frac + float64(r.halfTaps-1-j)
+			x := d / float64(r.halfTaps)
+			if x <= -1 || x >= 1 {
+				continue
+			}
+			taps[j] = cutoff * sinc(cutoff*d) * window.KaiserAt(x, resampleKaiserBeta)
+		}
+		r.phases[p] = taps
+	}
+	return r
+}
+
+// inputBase returns the index of the input sample at or just before output sample n.
+func (r *resampler) inputBase(n int64) int64 {
+	return n * int64(r.down) / int64(r.up)
+}
+
+// sample computes output sample n. in holds input samples starting at
+// absolute index offset; anything outside it is treated as silence.
+func (r *resampler) sample(in []float64, offset, n int64) float64 {
+	pos := n * int64(r.down)
+	base := pos / int64(r.up)
+	phase := int(pos % int64(r.up))
+	if len(r.phases) != r.up {
+		phase = phase * len(r.phases) / r.up
+	}
+	taps := r.phases[phase]
+
+	start := base - int64(r.halfTaps) + 1 - offset
+	sum := 0.0
+	for j, h := range taps {
+		k := start + int64(j)
+		if k < 0 || k >= int64(len(in)) {
+			continue
+		}
+		sum += in[k] * h
+	}
+	return sum
+}
+
+// streamResampler resamples a signal delivered in chunks, keeping only the
+// input history the filter still needs.
+type streamResampler struct {
+	*resampler
+	in     []float64 // buffered input, in[0] is input sample offset
+	offset int64
+	total  int64 // input samples received so far
+	next   int64 // index of the next output sample
+}
+
+func newStreamResampler(fromRate, toRate int) *streamResampler {
+	return &streamResampler{resampler: newResampler(fromRate, toRate)}
+}
+
+// process consumes a chunk of input and returns every output sample whose
+// filter taps are now fully available.
+func (s *streamResampler) process(samples []float64) []float64 {
+	s.in = append(s.in, samples...)
+	s.total += int64(len(samples))
+
+	var out []float64
+	for s.inputBase(s.next)+int64(s.halfTaps) < s.total {
+		out = append(out, s.sample(s.in, s.offset, s.next))
+		s.next++
+	}
+
+	// Drop input that no future output sample reaches
+	if drop := s.inputBase(s.next) - int64(s.halfTaps) + 1 - s.offset; drop > 0 {
+		if drop > int64(len(s.in)) {
+			drop = int64(len(s.in))
+		}
+		s.in = append(s.in[:0], s.in[drop:]...)
+		s.offset += drop
+	}
+	return out
+}
+
+// flush returns the remaining output samples once the input has ended.
+func (s *streamResampler) flush() []float64 {
+	n := s.total * int64(s.up) / int64(s.down)
+	var out []float64
+	for ; s.next < n; s.next++ {
+		out = append(out, s.sample(s.in, s.offset, s.next))
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,49 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// wavHeader returns a 44-byte canonical WAV header for a PCM data chunk of
+// dataSize bytes.
+func wavHeader(channels, sampleRate, bitDepth, dataSize int) []byte {
+	var b []byte
+	b = append(b, "RIFF"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(36+dataSize))
+	b = append(b, "WAVEfmt "...)
+	b = binary.LittleEndian.AppendUint32(b, 16)
+	b = binary.LittleEndian.AppendUint16(b, wavFormatPCM)
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+	b = binary.LittleEndian.AppendUint32(b, uint32(sampleRate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(sampleRate*channels*bitDepth/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels*bitDepth/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(bitDepth))
+	b = append(b, "data"...)
+	return binary.LittleEndian.AppendUint32(b, uint32(dataSize))
+}
+
+// TestImplausibleSampleRate opens WAV files whose header claims a sample
+// rate far beyond any real audio. They must be rejected before a
+// resampling filter is built for them.
+func TestImplausibleSampleRate(t *testing.T) {
+	for _, rate := range []int{MaxSampleRate + 1, 400000000, 4000000000} {
+		_, err := OpenStream(bytes.NewReader(wavHeader(1, rate, 16, 4)), Options{})
+		if err == nil {
+			t.Errorf("%d Hz: opened", rate)
+		}
+	}
+	if _, err := OpenStream(bytes.NewReader(wavHeader(1, 44100, 16, 4)), Options{SampleRate: 4000000000}); err == nil {
+		t.Error("resampling to 4 GHz: opened")
+	}
+}
+
+func TestResamplerTapsBounded(t *testing.T) {
+	for _, from := range []int{48000, 192000, MaxSampleRate} {
+		r := newResampler(from, 8000)
+		if r.halfTaps > resampleMaxHalfTaps || len(r.phases) > resampleMaxPhases {
+			t.Errorf("%d Hz -> 8 kHz: %d phases of %d taps", from, len(r.phases), 2*r.halfTaps)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+)
+
+// PCMReader yields decoded audio incrementally. Each Buffer holds a chunk of
+// interleaved samples; ReadPCM returns io.EOF after the last chunk.
+type PCMReader interface {
+	ReadPCM() (*Buffer, error)
+}
+
+// StreamDecoder is implemented by decoders that can decode incrementally.
+// OpenStream falls back to Decode for decoders that don't implement it.
+type StreamDecoder interface {
+	DecodeStream(r io.Reader) (PCMReader, error)
+}
+
+// Stream yields mono samples at a fixed sample rate without holding the
+// whole input in memory.
+type Stream interface {
+	// Read fills dst with up to len(dst) samples and returns how many were
+	// written. It returns io.EOF once all samples have been read.
+	Read(dst []float64) (int, error)
+	// SampleRate is the rate of the samples returned by Read.
+	SampleRate() int
+}
+
+// OpenStream detects the format of r and returns a Stream of mono samples,
+// mixed and resampled as described by opts.
+func OpenStream(r io.Reader, opts Options) (Stream, error) {
+	rate := opts.SampleRate
+	if rate == 0 {
+		rate = DefaultSampleRate
+	}
+	if err := checkSampleRate(rate); err != nil {
+		return nil, err
+	}
+	r, header, err := sniff(r)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := matchFormat(header)
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	fmt.Printf("audio: Detected %s format\n", f.name)
+
+	var pcm PCMReader
+	if sd, ok := f.decoder.(StreamDecoder); ok {
+		pcm, err = sd.DecodeStream(r)
+	} else {
+		var buf *Buffer
+		buf, err = f.decoder.Decode(r)
+		pcm = &bufferReader{buf: buf}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", f.name, err)
+	}
+
+	return &monoStream{pcm: pcm, opts: opts, rate: rate}, nil
+}
+
+// ReadAll reads s until EOF and returns all of its samples.
+func ReadAll(s Stream) ([]float64, error) {
+	var samples []float64
+	chunk := make([]float64, 8192)
+	for {
+		n, err := s.Read(chunk)
+		samples = append(samples, chunk[:n]...)
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readAllPCM concatenates every chunk from r into one Buffer.
+func readAllPCM(r PCMReader) (*Buffer, error) {
+	all := &Buffer{}
+	for {
+		buf, err := r.ReadPCM()
+		if err == io.EOF {
+			return all, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		all.Data = append(all.Data, buf.Data...)
+		all.Channels = buf.Channels
+		all.SampleRate = buf.SampleRate
+		all.BitDepth = buf.BitDepth
+	}
+}
+
+// bufferReader adapts an already decoded Buffer to PCMReader.
+type bufferReader struct {
+	buf *Buffer
+}
+
+func (b *bufferReader) ReadPCM() (*Buffer, error) {
+	if b.buf == nil {
+		return nil, io.EOF
+	}
+	buf := b.buf
+	b.buf = nil
+	return buf, nil
+}
+
+// monoStream mixes and resamples PCM chunks as they are decoded.
+type monoStream struct {
+	pcm       PCMReader
+	opts      Options
+	rate      int
+	resampler *streamResampler
+	pending   []float64
+	eof       bool
+}
+
+func (s *monoStream) SampleRate() int {
+	return s.rate
+}
+
+func (s *monoStream) Read(dst []float64) (int, error) {
+	for len(s.pending) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(dst, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// fill decodes the next chunk into s.pending.
+func (s *monoStream) fill() error {
+	buf, err := s.pcm.ReadPCM()
+	if err == io.EOF {
+		s.eof = true
+		if s.resampler != nil {
+			s.pending = s.resampler.flush()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	samples, err := buf.Mix(s.opts)
+	if err != nil {
+		return err
+	}
+	if buf.SampleRate != s.rate {
+		// Decoders other than WAV and FLAC report rates unchecked
+		if err := checkSampleRate(buf.SampleRate); err != nil {
+			return err
+		}
+		if s.resampler == nil {
+			fmt.Printf("audio: Resampling %d Hz -> %d Hz\n", buf.SampleRate, s.rate)
+			s.resampler = newStreamResampler(buf.SampleRate, s.rate)
+		}
+		samples = s.resampler.process(samples)
+	}
+	s.pending = samples
+	return nil
+}
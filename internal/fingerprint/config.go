@@ -0,0 +1,248 @@
+package fingerprint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"shazam-go/internal/window"
+)
+
+// DefaultPreset is the preset used when nothing else has been chosen.
+const DefaultPreset = "music-default"
+
+// Config holds every parameter that affects the fingerprints produced for a
+// piece of audio. References and queries must use the same Config or their
+// hashes will not line up.
+type Config struct {
+	Name string `json:"name,omitempty"`
+	// SampleRate is the rate (Hz) audio is resampled to before analysis.
+	SampleRate int `json:"sampleRate"`
+	// WindowSize is the FFT length in samples.
+	WindowSize int `json:"windowSize"`
+	// Overlap is the number of samples shared by consecutive FFT windows.
+	Overlap int `json:"overlap"`
+	// PeakNeighborhood is the half-size (in frames and bins) of the box a
+	// peak must dominate.
+	PeakNeighborhood int `json:"peakNeighborhood"`
+	// TargetZoneHeight is how many frames ahead of an anchor targets may lie.
+	TargetZoneHeight int `json:"targetZoneHeight"`
+	// TargetZoneWidth is how many frequency bins above or below the anchor
+	// targets may lie.
+	TargetZoneWidth int `json:"targetZoneWidth"`
+	// MinTimeDelta is the fewest frames a target must lie after its anchor;
+	// 1 excludes pairs within the same frame.
+	MinTimeDelta int `json:"minTimeDelta,omitempty"`
+	// FanOut caps the targets paired with each anchor; zero pairs with every
+	// peak in the target zone. FanOutBy picks which targets are kept: the
+	// nearest in time ("time", the default) or the strongest ("magnitude").
+	FanOut   int    `json:"fanOut,omitempty"`
+	FanOutBy string `json:"fanOutBy,omitempty"`
+
+	// Window is the window applied to each frame before the FFT (see the
+	// window package); empty means Hann. KaiserBeta shapes Kaiser windows.
+	Window     string  `json:"window,omitempty"`
+	KaiserBeta float64 `json:"kaiserBeta,omitempty"`
+
+	// MinFreq and MaxFreq (Hz) limit the spectrogram to a band of interest,
+	// e.g. what survives playback through a speaker into a phone mic. Zero
+	// means no limit.
+	MinFreq float64 `json:"minFreq,omitempty"`
+	MaxFreq float64 `json:"maxFreq,omitempty"`
+	// FreqScale groups FFT bins into FreqBands "log" or "mel" spaced bands.
+	// Empty or "linear" keeps every FFT bin.
+	FreqScale string `json:"freqScale,omitempty"`
+	FreqBands int    `json:"freqBands,omitempty"`
+	// MagnitudeScale is "db" for log-magnitude spectrograms; empty or
+	// "linear" keeps FFT magnitudes.
+	MagnitudeScale string `json:"magnitudeScale,omitempty"`
+
+	// EnvelopeSeconds is the time constant of the running spectral envelope
+	// that peaks are compared against. Zero disables adaptive thresholding
+	// and only an absolute magnitude floor applies.
+	EnvelopeSeconds float64 `json:"envelopeSeconds,omitempty"`
+	// ThresholdDB is how far above its local envelope a peak must rise.
+	// Thresholds are ratios on linear spectrograms and offsets on dB ones.
+	ThresholdDB float64 `json:"thresholdDB,omitempty"`
+	// FloorDB is the lowest peak level relative to the long-term loudness, so
+	// near-silent passages produce few peaks.
+	FloorDB float64 `json:"floorDB,omitempty"`
+	// PeaksPerSecond caps the peaks kept per second in each frequency band,
+	// strongest first. Zero keeps every peak.
+	PeaksPerSecond float64 `json:"peaksPerSecond,omitempty"`
+	// DensityBands is the number of log-spaced bands PeaksPerSecond applies to.
+	DensityBands int `json:"densityBands,omitempty"`
+}
+
+// Fan-out orders
+const (
+	FanOutByTime      = "time"
+	FanOutByMagnitude = "magnitude"
+)
+
+var presets = map[string]Config{
+	"music-default": {
+		SampleRate:       44100,
+		WindowSize:       4096,
+		Overlap:          2048,
+		PeakNeighborhood: 10,
+		TargetZoneHeight: 90,
+		TargetZoneWidth:  45,
+		MinTimeDelta:     1,
+		FanOut:           10,
+		MinFreq:          100,
+		MaxFreq:          5000,
+		MagnitudeScale:   ScaleDB,
+		EnvelopeSeconds:  0.5,
+		ThresholdDB:      6,
+		FloorDB:          -10,
+		PeaksPerSecond:   5,
+		DensityBands:     6,
+	},
+	// Speech has little energy above 4 kHz and changes faster than music
+	"speech": {
+		SampleRate:       16000,
+		WindowSize:       1024,
+		Overlap:          512,
+		PeakNeighborhood: 8,
+		TargetZoneHeight: 60,
+		TargetZoneWidth:  30,
+		MinTimeDelta:     1,
+		FanOut:           10,
+		MinFreq:          300,
+		MaxFreq:          3400,
+		FreqScale:        FreqMel,
+		FreqBands:        64,
+		MagnitudeScale:   ScaleDB,
+		EnvelopeSeconds:  0.3,
+		ThresholdDB:      6,
+		FloorDB:          -10,
+		PeaksPerSecond:   6,
+		DensityBands:     4,
+	},
+	// Shorter windows and target zones so matches need less audio
+	"low-latency": {
+		SampleRate:       44100,
+		WindowSize:       2048,
+		Overlap:          1024,
+		PeakNeighborhood: 8,
+		TargetZoneHeight: 45,
+		TargetZoneWidth:  30,
+		MinTimeDelta:     1,
+		FanOut:           15,
+		MinFreq:          100,
+		MaxFreq:          5000,
+		MagnitudeScale:   ScaleDB,
+		EnvelopeSeconds:  0.5,
+		ThresholdDB:      6,
+		FloorDB:          -10,
+		PeaksPerSecond:   8,
+		DensityBands:     6,
+	},
+}
+
+// DefaultConfig returns the "music-default" preset.
+func DefaultConfig() Config {
+	cfg, _ := Preset(DefaultPreset)
+	return cfg
+}
+
+// Preset returns the named preset configuration.
+func Preset(name string) (Config, error) {
+	cfg, ok := presets[name]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown fingerprint preset %q (available: %s)", name, strings.Join(PresetNames(), ", "))
+	}
+	cfg.Name = name
+	return cfg, nil
+}
+
+// PresetNames lists the available presets in alphabetical order.
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate reports whether the configuration can be used for fingerprinting.
+func (c Config) Validate() error {
+	if c.SampleRate <= 0 {
+		return fmt.Errorf("fingerprint config: sample rate must be positive, got %d", c.SampleRate)
+	}
+	if c.WindowSize < 2 {
+		return fmt.Errorf("fingerprint config: window size must be at least 2, got %d", c.WindowSize)
+	}
+	if c.Overlap < 0 || c.Overlap >= c.WindowSize {
+		return fmt.Errorf("fingerprint config: overlap must be in [0, %d), got %d", c.WindowSize, c.Overlap)
+	}
+	if c.PeakNeighborhood < 1 {
+		return fmt.Errorf("fingerprint config: peak neighborhood must be at least 1, got %d", c.PeakNeighborhood)
+	}
+	if c.TargetZoneHeight < 1 || c.TargetZoneHeight > MaxTargetZoneHeight {
+		return fmt.Errorf("fingerprint config: target zone height must be in [1, %d], got %d", MaxTargetZoneHeight, c.TargetZoneHeight)
+	}
+	if c.TargetZoneWidth < 0 {
+		return fmt.Errorf("fingerprint config: target zone width must not be negative, got %d", c.TargetZoneWidth)
+	}
+	if c.MinTimeDelta < 0 || c.MinTimeDelta > c.TargetZoneHeight {
+		return fmt.Errorf("fingerprint config: min time delta must be in [0, %d], got %d", c.TargetZoneHeight, c.MinTimeDelta)
+	}
+	if c.FanOut < 0 {
+		return fmt.Errorf("fingerprint config: fan-out must not be negative, got %d", c.FanOut)
+	}
+	switch c.FanOutBy {
+	case "", FanOutByTime, FanOutByMagnitude:
+	default:
+		return fmt.Errorf("fingerprint config: unknown fan-out order %q (want %s or %s)", c.FanOutBy, FanOutByTime, FanOutByMagnitude)
+	}
+	if _, err := window.Get(c.Window, c.WindowSize, c.KaiserBeta); err != nil {
+		return fmt.Errorf("fingerprint config: %v", err)
+	}
+	if c.MinFreq < 0 || c.MaxFreq < 0 {
+		return fmt.Errorf("fingerprint config: band limits must not be negative, got %g-%g Hz", c.MinFreq, c.MaxFreq)
+	}
+	if c.MaxFreq > 0 && c.MaxFreq <= c.MinFreq {
+		return fmt.Errorf("fingerprint config: max frequency %g Hz must be above min frequency %g Hz", c.MaxFreq, c.MinFreq)
+	}
+	switch c.FreqScale {
+	case "", FreqLinear:
+	case FreqLog, FreqMel:
+		if c.FreqBands < 1 {
+			return fmt.Errorf("fingerprint config: %s frequency scale needs at least 1 band, got %d", c.FreqScale, c.FreqBands)
+		}
+	default:
+		return fmt.Errorf("fingerprint config: unknown frequency scale %q (want %s, %s or %s)", c.FreqScale, FreqLinear, FreqLog, FreqMel)
+	}
+	switch c.MagnitudeScale {
+	case "", ScaleLinear, ScaleDB:
+	default:
+		return fmt.Errorf("fingerprint config: unknown magnitude scale %q (want %s or %s)", c.MagnitudeScale, ScaleLinear, ScaleDB)
+	}
+	bins := c.Bins()
+	if bins < 1 {
+		return fmt.Errorf("fingerprint config: no FFT bins between %g Hz and the %d Hz Nyquist frequency", c.MinFreq, c.SampleRate/2)
+	}
+	if c.EnvelopeSeconds < 0 {
+		return fmt.Errorf("fingerprint config: envelope time constant must not be negative, got %g", c.EnvelopeSeconds)
+	}
+	if c.PeaksPerSecond < 0 {
+		return fmt.Errorf("fingerprint config: peaks per second must not be negative, got %g", c.PeaksPerSecond)
+	}
+	if c.PeaksPerSecond > 0 && (c.DensityBands < 1 || c.DensityBands > bins) {
+		return fmt.Errorf("fingerprint config: density bands must be in [1, %d], got %d", bins, c.DensityBands)
+	}
+	return nil
+}
+
+// HopSize is the number of samples between the starts of consecutive frames.
+func (c Config) HopSize() int {
+	return c.WindowSize - c.Overlap
+}
+
+// FrameTime converts a frame index to seconds from the start of the audio.
+func (c Config) FrameTime(frame int) float64 {
+	return float64(frame*c.HopSize()) / float64(c.SampleRate)
+}
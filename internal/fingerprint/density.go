@@ -0,0 +1,118 @@
+package fingerprint
+
+import (
+	"math"
+	"sort"
+)
+
+// densityLimiter caps the number of peaks per frequency band to
+// PeaksPerSecond, keeping the strongest ones. Peaks are grouped into
+// one-second windows of frames and released when their window closes.
+type densityLimiter struct {
+	peaksPerSecond  float64
+	framesPerSecond float64
+	windowFrames    int
+	bands           int
+	edges           []int // exclusive upper bin of each band
+	windowStart     int
+	pending         []Peak
+}
+
+// newDensityLimiter returns nil when density control is disabled.
+func newDensityLimiter(cfg Config) *densityLimiter {
+	if cfg.PeaksPerSecond <= 0 {
+		return nil
+	}
+	framesPerSecond := float64(cfg.SampleRate) / float64(cfg.HopSize())
+	windowFrames := int(math.Round(framesPerSecond))
+	if windowFrames < 1 {
+		windowFrames = 1
+	}
+	return &densityLimiter{
+		peaksPerSecond:  cfg.PeaksPerSecond,
+		framesPerSecond: framesPerSecond,
+		windowFrames:    windowFrames,
+		bands:           cfg.DensityBands,
+	}
+}
+
+// setBins splits bins frequency bins into log-spaced bands, so each band
+// spans roughly the same number of octaves.
+func (l *densityLimiter) setBins(bins int) {
+	if len(l.edges) > 0 && l.edges[len(l.edges)-1] == bins {
+		return
+	}
+	l.edges = l.edges[:0]
+	prev := 0
+	for i := 1; i <= l.bands; i++ {
+		edge := int(math.Round(math.Pow(float64(bins), float64(i)/float64(l.bands))))
+		if edge <= prev {
+			edge = prev + 1
+		}
+		if edge > bins || i == l.bands {
+			edge = bins
+		}
+		l.edges = append(l.edges, edge)
+		prev = edge
+	}
+}
+
+// push queues peaks from frames before done and returns the peaks of every
+// window that is now complete.
+func (l *densityLimiter) push(peaks []Peak, done int) []Peak {
+	l.pending = append(l.pending, peaks...)
+	var out []Peak
+	for l.windowStart+l.windowFrames <= done {
+		out = append(out, l.closeWindow(l.windowFrames)...)
+	}
+	return out
+}
+
+// flush returns the peaks of the final, possibly partial, window.
+func (l *densityLimiter) flush(peaks []Peak, frames int) []Peak {
+	out := l.push(peaks, frames)
+	if frames > l.windowStart {
+		out = append(out, l.closeWindow(frames-l.windowStart)...)
+	}
+	return out
+}
+
+// closeWindow keeps the strongest peaks of each band among those in the
+// current window of the given length and returns them in time order.
+func (l *densityLimiter) closeWindow(frames int) []Peak {
+	end := l.windowStart + frames
+	quota := int(math.Round(l.peaksPerSecond * float64(frames) / l.framesPerSecond))
+	if quota < 1 {
+		quota = 1
+	}
+
+	split := sort.Search(len(l.pending), func(i int) bool { return l.pending[i].Time >= end })
+	window := l.pending[:split]
+	byBand := make([][]Peak, l.bands)
+	for _, p := range window {
+		b := sort.SearchInts(l.edges, p.Freq+1)
+		if b >= l.bands {
+			b = l.bands - 1
+		}
+		byBand[b] = append(byBand[b], p)
+	}
+
+	var kept []Peak
+	for _, band := range byBand {
+		if len(band) > quota {
+			sort.SliceStable(band, func(i, j int) bool { return band[i].Magnitude > band[j].Magnitude })
+			band = band[:quota]
+		}
+		kept = append(kept, band...)
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].Time != kept[j].Time {
+			return kept[i].Time < kept[j].Time
+		}
+		return kept[i].Freq < kept[j].Freq
+	})
+
+	l.pending = append(l.pending[:0], l.pending[split:]...)
+	l.windowStart = end
+	return kept
+}
@@ -0,0 +1,102 @@
+package fingerprint
+
+import "math"
+
+// minPeakMagnitude is the absolute floor below which nothing is a peak.
+const minPeakMagnitude = 0.00000000000000001
+
+// loudnessSeconds is the time constant of the long-term loudness that the
+// FloorDB threshold follows. It is much longer than a note so that quiet
+// passages after loud ones are recognized as quiet.
+const loudnessSeconds = 10.0
+
+// envelope tracks the running spectral envelope of a spectrogram and derives
+// a per-bin peak threshold from it. The envelope of a bin is the magnitude
+// averaged over the peak neighborhood in frequency, then smoothed over time
+// with an exponential moving average of EnvelopeSeconds. On dB spectrograms
+// the thresholds are offsets rather than ratios.
+type envelope struct {
+	neighborhood int
+	alpha        float64 // per-frame decay of the local envelope
+	loudAlpha    float64 // per-frame decay of the loudness
+	db           bool
+	ratio        float64 // ThresholdDB, linear unless db
+	floor        float64 // FloorDB, linear unless db
+	local        []float64
+	loudness     float64 // long-term mean bin magnitude
+	sums         []float64
+	started      bool
+}
+
+// newEnvelope returns nil when adaptive thresholding is disabled.
+func newEnvelope(cfg Config) *envelope {
+	if cfg.EnvelopeSeconds <= 0 {
+		return nil
+	}
+	frameSeconds := float64(cfg.HopSize()) / float64(cfg.SampleRate)
+	e := &envelope{
+		neighborhood: cfg.PeakNeighborhood,
+		alpha:        math.Exp(-frameSeconds / cfg.EnvelopeSeconds),
+		loudAlpha:    math.Exp(-frameSeconds / loudnessSeconds),
+		db:           cfg.MagnitudeScale == ScaleDB,
+		ratio:        cfg.ThresholdDB,
+		floor:        cfg.FloorDB,
+	}
+	if !e.db {
+		e.ratio = math.Pow(10, cfg.ThresholdDB/20)
+		e.floor = math.Pow(10, cfg.FloorDB/20)
+	}
+	return e
+}
+
+// update folds the next frame into the envelope and writes the threshold
+// each of its bins must reach to dst.
+func (e *envelope) update(frame, dst []float64) {
+	n := len(frame)
+	if len(e.local) != n {
+		e.local = make([]float64, n)
+		e.sums = make([]float64, n+1)
+		e.started = false
+	}
+	for c, v := range frame {
+		e.sums[c+1] = e.sums[c] + v
+	}
+	mean := 0.0
+	if n > 0 {
+		mean = e.sums[n] / float64(n)
+	}
+
+	for c := range frame {
+		lo, hi := c-e.neighborhood, c+e.neighborhood+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > n {
+			hi = n
+		}
+		smoothed := (e.sums[hi] - e.sums[lo]) / float64(hi-lo)
+		if e.started {
+			e.local[c] = e.alpha*e.local[c] + (1-e.alpha)*smoothed
+		} else {
+			e.local[c] = smoothed
+		}
+	}
+	if e.started {
+		e.loudness = e.loudAlpha*e.loudness + (1-e.loudAlpha)*mean
+	} else {
+		e.loudness = mean
+	}
+	e.started = true
+
+	if e.db {
+		floor := maxOf(e.loudness+e.floor, minPeakMagnitude)
+		for c := range dst {
+			dst[c] = maxOf(e.local[c]+e.ratio, floor)
+		}
+		return
+	}
+	floor := maxOf(e.loudness*e.floor, minPeakMagnitude)
+	for c := range dst {
+		dst[c] = maxOf(e.local[c]*e.ratio, floor)
+	}
+}
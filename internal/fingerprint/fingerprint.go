@@ -3,142 +3,216 @@ package fingerprint
 import (
 	"fmt"
 	"gonum.org/v1/gonum/dsp/fourier"
+	"io"
 	"math"
+	"sort"
 	"sync"
 	"runtime"
-)
 
-const (
-	fftWindowSize=4096
-	fftOverLap=2048
-	peakNeighborhood=10
-	targetZoneHeight=90
-	targetZoneWidth=45
+	"shazam-go/internal/window"
 )
 
-func GenerateSpectogram(monoSamples []float64,sampleRate int) ([][]float64,error){
-	fmt.Println("fingerprint: Generating fingerprints...")
-	// Debug: check input sample range
-		if len(monoSamples) > 0 {
-			min, max := monoSamples[0], monoSamples[0]
-			for _, s := range monoSamples {
-				if s < min {
-					min = s
-				}
-				if s > max {
-					max = s
-				}
-			}
-			fmt.Printf("fingerprint: Input sample range: [%.6f, %.6f]\n", min, max)
+// SampleReader is a source of mono samples, such as an audio.Stream.
+// Read returns io.EOF once the input is exhausted.
+type SampleReader interface {
+	Read(dst []float64) (int, error)
+}
+
+// sliceReader serves an in-memory signal through SampleReader.
+type sliceReader struct {
+	samples []float64
+}
+
+func (s *sliceReader) Read(dst []float64) (int, error) {
+	if len(s.samples) == 0 {
+		return 0, io.EOF
 	}
+	n := copy(dst, s.samples)
+	s.samples = s.samples[n:]
+	return n, nil
+}
+
+func GenerateSpectogram(monoSamples []float64,cfg Config) ([][]float64,error){
 	var spectrogram [][]float64
-	// Create Hann window manually: w[k] = 0.5*(1 - cos(2*π*k/(N-1)))
-		hann := make([]float64, fftWindowSize)
-		if fftWindowSize > 1 {
-			for i := 0; i < fftWindowSize; i++ {
-				hann[i] = 0.5 * (1.0 - math.Cos(2.0*math.Pi*float64(i)/float64(fftWindowSize-1)))
-			}
-	} else {
-		hann[0] = 1.0
+	err := GenerateSpectogramStream(&sliceReader{samples: monoSamples}, cfg, func(frame []float64) error {
+		spectrogram = append(spectrogram, frame)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	// Debug: check window values
-		hannMin, hannMax := hann[0], hann[0]
-		for _, v := range hann {
-			if v < hannMin {
-				hannMin = v
-			}
-			if v > hannMax {
-				hannMax = v
-			}
+	return spectrogram, nil
+}
+
+// GenerateSpectogramStream computes the spectrogram of r one frame at a time,
+// passing each frame of FFT magnitudes to emit in order. Only a bounded
+// number of analysis windows are held in memory, however long the input is.
+// FFTs run on runtime.NumCPU workers; emit is always called from the calling
+// goroutine.
+func GenerateSpectogramStream(r SampleReader, cfg Config, emit func(frame []float64) error) error {
+	return generateSpectogramStream(r, cfg, runtime.NumCPU(), emit)
+}
+
+// stftJob is one analysis window to transform. samples comes from the
+// window pool and is returned to it by the worker.
+type stftJob struct {
+	index   int
+	samples *[]float64
+}
+
+type stftResult struct {
+	index int
+	frame []float64
+}
+
+func generateSpectogramStream(r SampleReader, cfg Config, workers int, emit func(frame []float64) error) error {
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-	fmt.Printf("fingerprint: Hann window range: [%.6f, %.6f]\n", hannMin, hannMax)
-	fmt.Printf("fingerprint: Hann window first 5 values: [%.6f, %.6f, %.6f, %.6f, %.6f]\n", 
-		hann[0], hann[1], hann[2], hann[3], hann[4])
-	fft:=fourier.NewFFT(fftWindowSize)
-	size:=len(monoSamples)
-	// fftWindowSize:=512
-	// fftOverLap:=256
-	segmentCount := 0
-	for i:=0;i<=size-fftWindowSize;i+=fftWindowSize-fftOverLap{
-		chunk:=make([]float64,fftWindowSize)
-		copy(chunk,monoSamples[i:i+fftWindowSize])
-		// Debug first chunk
-		if segmentCount == 0 {
-			chunkMin, chunkMax := chunk[0], chunk[0]
-			for _, v := range chunk {
-				if v < chunkMin {
-					chunkMin = v
-				}
-				if v > chunkMax {
-					chunkMax = v
-				}
+	if workers < 1 {
+		workers = 1
+	}
+	fmt.Println("fingerprint: Generating fingerprints...")
+	fftWindowSize := cfg.WindowSize
+	taper, err := window.Get(cfg.Window, fftWindowSize, cfg.KaiserBeta)
+	if err != nil {
+		return err
+	}
+	hop := cfg.HopSize()
+	shaper := newSpectrumShaper(cfg)
+
+	pool := sync.Pool{New: func() any {
+		buf := make([]float64, fftWindowSize)
+		return &buf
+	}}
+	jobs := make(chan stftJob, workers)
+	results := make(chan stftResult, workers)
+	done := make(chan struct{})
+	defer close(done)
+	// inFlight bounds the frames read but not yet emitted, so a slow worker
+	// can't make finished frames pile up behind it
+	inFlight := make(chan struct{}, 2*workers)
+
+	// Read overlapping windows and hand out copies to the workers
+	var readErr error
+	go func() {
+		defer close(jobs)
+		// samples holds the current analysis window; after each frame it slides by hop
+		samples := make([]float64, fftWindowSize)
+		filled, err := readFull(r, samples)
+		for index := 0; err == nil && filled == fftWindowSize; index++ {
+			select {
+			case inFlight <- struct{}{}:
+			case <-done:
+				return
+			}
+			buf := pool.Get().(*[]float64)
+			copy(*buf, samples)
+			select {
+			case jobs <- stftJob{index: index, samples: buf}:
+			case <-done:
+				return
 			}
-			fmt.Printf("fingerprint: First chunk range (before window): [%.6f, %.6f]\n", chunkMin, chunkMax)
+
+			copy(samples, samples[hop:])
+			var n int
+			n, err = readFull(r, samples[fftWindowSize-hop:])
+			filled = fftWindowSize - hop + n
 		}
-		for j:=0;j<fftWindowSize;j++{
-			chunk[j]*=hann[j]
+		if err != nil && err != io.EOF {
+			readErr = err
 		}
-		// Debug first chunk after windowing
-		if segmentCount == 0 {
-			chunkMin, chunkMax := chunk[0], chunk[0]
-			for _, v := range chunk {
-				if v < chunkMin {
-					chunkMin = v
+	}()
+
+	// Each worker owns its FFT plan and scratch buffers
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fft := fourier.NewFFT(fftWindowSize)
+			chunk := make([]float64, fftWindowSize)
+			coeff := make([]complex128, fftWindowSize/2+1)
+			magnitudes := make([]float64, len(coeff))
+			for job := range jobs {
+				for j, v := range *job.samples {
+					chunk[j] = v * taper[j]
 				}
-				if v > chunkMax {
-					chunkMax = v
+				pool.Put(job.samples)
+				coeff = fft.Coefficients(coeff, chunk)
+				for j, c := range coeff {
+					magnitudes[j] = math.Sqrt(real(c)*real(c) + imag(c)*imag(c))
+				}
+				select {
+				case results <- stftResult{index: job.index, frame: shaper.shape(magnitudes)}:
+				case <-done:
+					return
 				}
 			}
-			fmt.Printf("fingerprint: First chunk range (after window): [%.6f, %.6f]\n", chunkMin, chunkMax)
-		}
-		coeff:=fft.Coefficients(nil,chunk)
-		// Debug first FFT coefficients
-		if segmentCount == 0 && len(coeff) > 0 {
-			fmt.Printf("fingerprint: First FFT coeff[0]: real=%.6f, imag=%.6f\n", real(coeff[0]), imag(coeff[0]))
-			if len(coeff) > 1 {
-				fmt.Printf("fingerprint: First FFT coeff[1]: real=%.6f, imag=%.6f\n", real(coeff[1]), imag(coeff[1]))
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Emit frames in order as they complete
+	pending := make(map[int][]float64)
+	segmentCount := 0
+	maxMag := 0.0
+	for res := range results {
+		pending[res.index] = res.frame
+		for {
+			frame, ok := pending[segmentCount]
+			if !ok {
+				break
 			}
-		}
-		magnitudes:=make([]float64,len(coeff))
-		for j,c:=range coeff{
-			magnitudes[j]=math.Sqrt(real(c)*real(c)+imag(c)*imag(c))
-		}
-		// Debug first magnitudes
-		if segmentCount == 0 && len(magnitudes) > 0 {
-			magMin, magMax := magnitudes[0], magnitudes[0]
-			for _, v := range magnitudes {
-				if v < magMin {
-					magMin = v
-				}
-				if v > magMax {
-					magMax = v
+			delete(pending, segmentCount)
+			for _, m := range frame {
+				if m > maxMag {
+					maxMag = m
 				}
 			}
-			fmt.Printf("fingerprint: First segment magnitude range: [%.6f, %.6f]\n", magMin, magMax)
+			if err := emit(frame); err != nil {
+				return err
+			}
+			<-inFlight
+			segmentCount++
 		}
-		spectrogram=append(spectrogram,magnitudes)
-		segmentCount++
 	}
-	// Debug: check max magnitude in spectrogram
-	maxMag := 0.0
-	for _, row := range spectrogram {
-		for _, val := range row {
-			if val > maxMag {
-				maxMag = val
-			}
+	if readErr != nil {
+		return readErr
+	}
+	fmt.Printf("fingerprint: %d segments, max magnitude in spectrogram: %f\n", segmentCount, maxMag)
+	return nil
+}
+
+// readFull reads until buf is full or r is exhausted. It returns io.EOF only
+// when r ran out before buf was filled.
+func readFull(r SampleReader, buf []float64) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := r.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
 		}
 	}
-	fmt.Printf("fingerprint: Max magnitude in spectrogram: %f\n", maxMag)
-	return spectrogram,nil
+	return total, nil
 }
 
+// Peak is a spectrogram local maximum. Freq indexes the spectrogram's bins
+// (see Config.Bins), which are FFT bins unless the config groups them.
 type Peak struct{
 	Time int
 	Freq int
+	Magnitude float64
 }
 
-func ExtractPeaks(spectrogram [][]float64,sampleRate int) ([]Peak,error){
-	var peaks []Peak
+func ExtractPeaks(spectrogram [][]float64,cfg Config) ([]Peak,error){
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	// Debug: count points above threshold
 	aboveThreshold := 0
 	for r:=0;r<len(spectrogram);r++{
@@ -150,63 +224,278 @@ func ExtractPeaks(spectrogram [][]float64,sampleRate int) ([]Peak,error){
 	}
 	fmt.Printf("fingerprint: Points above threshold (0.1): %d\n", aboveThreshold)
 
-	for r:=0;r<len(spectrogram);r++{
-		for c:=0;c<len(spectrogram[r]);c++{
+	picker := NewPeakPicker(cfg)
+	var peaks []Peak
+	for _, frame := range spectrogram {
+		peaks = append(peaks, picker.Push(frame)...)
+	}
+	peaks = append(peaks, picker.Flush()...)
+	return peaks,nil
+}
+
+// PeaksFromStream runs the spectrogram and peak picking over r incrementally,
+// so only the constellation map (not the spectrogram) is kept in memory.
+func PeaksFromStream(r SampleReader, cfg Config) ([]Peak, error) {
+	picker := NewPeakPicker(cfg)
+	var peaks []Peak
+	err := GenerateSpectogramStream(r, cfg, func(frame []float64) error {
+		peaks = append(peaks, picker.Push(frame)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	peaks = append(peaks, picker.Flush()...)
+	return peaks, nil
+}
+
+// PeakPicker finds local maxima in a spectrogram delivered one frame at a
+// time. A frame's peaks are reported once every frame in its neighborhood
+// has been pushed, so only 2*PeakNeighborhood+1 frames are kept.
+//
+// Neighborhood maxima come from a separable van Herk/Gil-Werman max filter
+// (see maxfilter.go): each frame is filtered along frequency when pushed, and
+// the time pass combines block prefix and suffix maxima of the filtered frames.
+type PeakPicker struct {
+	neighborhood int
+	// Ring buffers indexed by frame number. Time blocks start at multiples
+	// of the ring size.
+	frames   [][]float64
+	filtered [][]float64 // frame maxima along frequency
+	prefix   [][]float64 // max of filtered frames from the block start
+	suffix   [][]float64 // max of filtered frames to the block end
+	scratch  [2][]float64
+	pushed   int // number of frames pushed so far
+	next     int // next frame to evaluate
+
+	// Optional adaptive thresholds and density control
+	envelope   *envelope
+	thresholds [][]float64 // ring buffer of per-bin thresholds
+	limiter    *densityLimiter
+}
+
+func NewPeakPicker(cfg Config) *PeakPicker {
+	size := 2*cfg.PeakNeighborhood + 1
+	return &PeakPicker{
+		neighborhood: cfg.PeakNeighborhood,
+		frames:       make([][]float64, size),
+		filtered:     make([][]float64, size),
+		prefix:       make([][]float64, size),
+		suffix:       make([][]float64, size),
+		envelope:     newEnvelope(cfg),
+		thresholds:   make([][]float64, size),
+		limiter:      newDensityLimiter(cfg),
+	}
+}
+
+// Push adds the next spectrogram frame and returns any peaks that are now final.
+func (p *PeakPicker) Push(frame []float64) []Peak {
+	p.addFrame(frame)
+	if p.pushed%len(p.frames) == 0 {
+		p.finishBlock()
+	}
+	var peaks []Peak
+	for ; p.next+p.neighborhood < p.pushed; p.next++ {
+		peaks = p.appendPeaks(peaks, p.next)
+	}
+	if p.limiter != nil {
+		peaks = p.limiter.push(peaks, p.next)
+	}
+	return peaks
+}
+
+// Flush returns the peaks of the trailing frames once the input has ended.
+func (p *PeakPicker) Flush() []Peak {
+	if p.pushed%len(p.frames) != 0 {
+		p.finishBlock()
+	}
+	var peaks []Peak
+	for ; p.next < p.pushed; p.next++ {
+		peaks = p.appendPeaks(peaks, p.next)
+	}
+	if p.limiter != nil {
+		peaks = p.limiter.flush(peaks, p.pushed)
+	}
+	return peaks
+}
+
+func (p *PeakPicker) slot(r int) int {
+	return r % len(p.frames)
+}
+
+// addFrame stores frame, filters it along frequency and extends the prefix
+// maxima of its time block.
+func (p *PeakPicker) addFrame(frame []float64) {
+	n := len(frame)
+	if len(p.scratch[0]) < n {
+		p.scratch = [2][]float64{make([]float64, n), make([]float64, n)}
+	}
+	r := p.pushed
+	s := p.slot(r)
+	p.frames[s] = frame
+	p.filtered[s] = resize(p.filtered[s], n)
+	slidingMax(p.filtered[s], frame, p.scratch[0][:n], p.scratch[1][:n], p.neighborhood)
+
+	p.prefix[s] = resize(p.prefix[s], n)
+	if r%len(p.frames) == 0 {
+		copy(p.prefix[s], p.filtered[s])
+	} else {
+		prev := p.prefix[p.slot(r-1)]
+		for c := range p.prefix[s] {
+			p.prefix[s][c] = maxOf(prev[c], p.filtered[s][c])
+		}
+	}
+
+	if p.envelope != nil {
+		p.thresholds[s] = resize(p.thresholds[s], n)
+		p.envelope.update(frame, p.thresholds[s])
+	}
+	if p.limiter != nil {
+		p.limiter.setBins(n)
+	}
+	p.pushed++
+}
+
+// finishBlock computes the suffix maxima of the last time block, which is
+// complete or, at the end of the input, as complete as it will get.
+func (p *PeakPicker) finishBlock() {
+	k := len(p.frames)
+	start := (p.pushed - 1) / k * k
+	var next []float64
+	for r := p.pushed - 1; r >= start; r-- {
+		s := p.slot(r)
+		p.suffix[s] = resize(p.suffix[s], len(p.filtered[s]))
+		if next == nil {
+			copy(p.suffix[s], p.filtered[s])
+		} else {
+			for c := range p.suffix[s] {
+				p.suffix[s][c] = maxOf(next[c], p.filtered[s][c])
+			}
+		}
+		next = p.suffix[s]
+	}
+}
+
+// appendPeaks appends the peaks of frame r: points above their threshold
+// that are the maximum of their neighborhood box.
+func (p *PeakPicker) appendPeaks(peaks []Peak, r int) []Peak {
+	row := p.frames[p.slot(r)]
+	var thresholds []float64
+	if p.envelope != nil {
+		thresholds = p.thresholds[p.slot(r)]
+	}
+	lo, hi := r-p.neighborhood, r+p.neighborhood
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > p.pushed-1 {
+		hi = p.pushed - 1
+	}
+	useSuffix, usePrefix := windowParts(lo, hi, len(p.frames))
+	suffix, prefix := p.suffix[p.slot(lo)], p.prefix[p.slot(hi)]
+	for c := 0; c < len(row); c++ {
 		// Only consider peaks above a minimum magnitude threshold
-		if spectrogram[r][c] < 0.00000000000000001 {
+		if row[c] < minPeakMagnitude || (thresholds != nil && row[c] < thresholds[c]) {
 			continue
 		}
-		//now to create the box
-		maxVal:=spectrogram[r][c]
-		for nr:=r-peakNeighborhood;nr<=r+peakNeighborhood;nr++{
-			for nc:=c-peakNeighborhood;nc<=c+peakNeighborhood;nc++{
-				if nr<0 || nr>=len(spectrogram) || nc<0 || nc>=len(spectrogram[nr]){
-					continue
-				}
-				if spectrogram[nr][nc]>maxVal{
-					maxVal=spectrogram[nr][nc]
-				}
-			}
+		var maxVal float64
+		switch {
+		case useSuffix && usePrefix:
+			maxVal = maxOf(suffix[c], prefix[c])
+		case usePrefix:
+			maxVal = prefix[c]
+		default:
+			maxVal = suffix[c]
 		}
-		if spectrogram[r][c]==maxVal{
-			peaks=append(peaks,Peak{
-				Time: r,
-				Freq: c,
+		if row[c] == maxVal {
+			peaks = append(peaks, Peak{
+				Time:      r,
+				Freq:      c,
+				Magnitude: row[c],
 			})
 		}
-		}
 	}
-	return peaks,nil
+	return peaks
+}
+
+// resize returns buf resliced to n values, reallocating if it is too small.
+func resize(buf []float64, n int) []float64 {
+	if cap(buf) < n {
+		return make([]float64, n)
+	}
+	return buf[:n]
 }
 
-type workerResult struct{
-	hash uint32
-	time float64
+// Hash is a single fingerprint: a hashed anchor/target peak pair and the
+// time (in seconds) of the anchor peak. A song usually contains the same
+// hash value at several times, e.g. in every repetition of a chorus.
+type Hash struct {
+	Hash       uint32
+	AnchorTime float64
 }
 
-func GenerateHashes(peaks []Peak, sampleRate int) (map[uint32]float64, error) {
-	numWorkers := runtime.NumCPU()
+// GenerateHashes pairs each anchor peak with the peaks in its target zone,
+// at most FanOut of them. Hashes are returned in anchor order, then target
+// order, so the output for given peaks is the same however the work is
+// scheduled.
+func GenerateHashes(peaks []Peak, cfg Config) ([]Hash, error) {
+	return generateHashes(peaks, cfg, runtime.NumCPU())
+}
+
+func generateHashes(peaks []Peak, cfg Config, numWorkers int) ([]Hash, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	targetZoneHeight := cfg.TargetZoneHeight
+	targetZoneWidth := cfg.TargetZoneWidth
+	minTimeDelta := cfg.MinTimeDelta
+	fanOut := cfg.FanOut
+	byMagnitude := cfg.FanOutBy == FanOutByMagnitude
+	freqShift := cfg.freqShift()
 	jobsChan := make(chan int, len(peaks))
-	resultsChan := make(chan workerResult, len(peaks))
+	// Each anchor's hashes go to their own slot, so no ordering depends on
+	// which worker finishes first
+	perAnchor := make([][]Hash, len(peaks))
 
 	var wg sync.WaitGroup
 	worker := func(workerID int) {
 		defer wg.Done()
 		for anchorIndex := range jobsChan {
 			anchor := peaks[anchorIndex]
+			anchorTime := cfg.FrameTime(anchor.Time)
+			// Peaks are in time order, so the first targets found are the nearest
+			var targets []int
 			for j := anchorIndex + 1; j < len(peaks) && (peaks[j].Time-anchor.Time) <= targetZoneHeight; j++ {
 				target := peaks[j]
+				if target.Time-anchor.Time < minTimeDelta {
+					continue
+				}
 				if math.Abs(float64(target.Freq-anchor.Freq)) <= float64(targetZoneWidth) {
-					timeDelta := target.Time - anchor.Time
-					hash := (uint32(anchor.Freq) << 22) | (uint32(target.Freq) << 12) | (uint32(timeDelta))
-					anchorTime := float64(anchor.Time*(fftWindowSize-fftOverLap)) / float64(sampleRate)
-					fmt.Printf("Generated hash: %d at time: %f\n",hash,anchorTime)
-					resultsChan <- workerResult{
-						hash: hash,
-						time: anchorTime,
+					targets = append(targets, j)
+					if fanOut > 0 && !byMagnitude && len(targets) == fanOut {
+						break
 					}
 				}
 			}
+			if fanOut > 0 && byMagnitude && len(targets) > fanOut {
+				sort.SliceStable(targets, func(a, b int) bool {
+					return peaks[targets[a]].Magnitude > peaks[targets[b]].Magnitude
+				})
+				targets = targets[:fanOut]
+				sort.Ints(targets)
+			}
+
+			hashes := make([]Hash, len(targets))
+			for i, j := range targets {
+				hashes[i] = Hash{
+					Hash:       packHash(anchor, peaks[j], freqShift),
+					AnchorTime: anchorTime,
+				}
+			}
+			perAnchor[anchorIndex] = hashes
 		}
 	}
 
@@ -219,17 +508,18 @@ func GenerateHashes(peaks []Peak, sampleRate int) (map[uint32]float64, error) {
 		jobsChan <- i
 	}
 	close(jobsChan)
+	wg.Wait()
 
-	go func() {
-		wg.Wait()
-		close(resultsChan)
-	}()
-
-	finalHashes := make(map[uint32]float64)
-	for result := range resultsChan {
-		finalHashes[result.hash] = result.time
+	// Keep every occurrence; collapsing to one timestamp per hash would
+	// throw away most of the evidence for time-coherent matching
+	total := 0
+	for _, hashes := range perAnchor {
+		total += len(hashes)
+	}
+	finalHashes := make([]Hash, 0, total)
+	for _, hashes := range perAnchor {
+		finalHashes = append(finalHashes, hashes...)
 	}
 
 	return finalHashes, nil
 }
-
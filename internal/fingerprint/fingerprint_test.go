@@ -0,0 +1,91 @@
+package fingerprint
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// chunkReader serves samples a few at a time, as a decoder handing over
+// short reads would.
+type chunkReader struct {
+	samples []float64
+	chunk   int
+}
+
+func (c *chunkReader) Read(dst []float64) (int, error) {
+	if len(dst) > c.chunk {
+		dst = dst[:c.chunk]
+	}
+	r := sliceReader{samples: c.samples}
+	n, err := r.Read(dst)
+	c.samples = r.samples
+	return n, err
+}
+
+// spectrogramOf runs generateSpectogramStream over r with the given number
+// of workers and collects the frames it emits.
+func spectrogramOf(t *testing.T, r SampleReader, cfg Config, workers int) [][]float64 {
+	t.Helper()
+	var frames [][]float64
+	err := generateSpectogramStream(r, cfg, workers, func(frame []float64) error {
+		frames = append(frames, frame)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func equalFrames(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Float64bits(a[i]) != math.Float64bits(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestSpectrogramWorkers checks that the spectrogram is the same frames in
+// the same order whatever the number of workers, including more workers
+// than frames. Frame k must be the spectrum of the k-th analysis window on
+// its own, so frames emitted out of order would fail even if every worker
+// count agreed.
+func TestSpectrogramWorkers(t *testing.T) {
+	cfg := DefaultConfig()
+	hop := cfg.HopSize()
+	rng := rand.New(rand.NewSource(1))
+	for _, numFrames := range []int{1, 5, 60} {
+		samples := make([]float64, cfg.WindowSize+(numFrames-1)*hop+hop/2)
+		for i := range samples {
+			samples[i] = math.Sin(2*math.Pi*float64(i)*(0.01+float64(i)*1e-6)) + 0.3*rng.NormFloat64()
+		}
+
+		want := make([][]float64, numFrames)
+		for k := range want {
+			frame := spectrogramOf(t, &sliceReader{samples: samples[k*hop : k*hop+cfg.WindowSize]}, cfg, 1)
+			if len(frame) != 1 {
+				t.Fatalf("one analysis window gave %d frames", len(frame))
+			}
+			want[k] = frame[0]
+		}
+
+		for _, workers := range []int{1, 2, 3, 8, numFrames + 1, 64} {
+			for _, r := range []SampleReader{&sliceReader{samples: samples}, &chunkReader{samples: samples, chunk: 7}} {
+				got := spectrogramOf(t, r, cfg, workers)
+				if len(got) != numFrames {
+					t.Fatalf("%d frames, %d workers: got %d frames", numFrames, workers, len(got))
+				}
+				for k := range got {
+					if !equalFrames(got[k], want[k]) {
+						t.Fatalf("%d frames, %d workers: frame %d differs from its window's spectrum", numFrames, workers, k)
+					}
+				}
+			}
+		}
+	}
+}
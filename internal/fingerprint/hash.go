@@ -0,0 +1,48 @@
+package fingerprint
+
+// HashVersion identifies the bit layout produced by GenerateHashes. Databases
+// record it so hashes from different layouts are never compared.
+//
+// Version 1 packed anchorFreq<<22 | targetFreq<<12 | timeDelta. Frequency
+// bins reach 2048 and deltas reach the target zone height, so the fields
+// overlapped and distinct peak pairs could produce the same hash.
+//
+// Version 2 uses disjoint fields, from the most significant bit:
+//
+//	bits 31-20  anchor frequency bin >> freqShift   (12 bits)
+//	bits 19-8   target frequency bin >> freqShift   (12 bits)
+//	bits  7-0   time delta in frames                (8 bits)
+//
+// freqShift is the smallest shift that fits the highest spectrogram bin into
+// 12 bits; it is 0 unless a frame has more than 4096 bins (a window over 8190
+// samples without bin grouping).
+const HashVersion = 2
+
+const (
+	hashFreqBits  = 12
+	hashDeltaBits = 8
+
+	hashFreqMask  = 1<<hashFreqBits - 1
+	hashDeltaMask = 1<<hashDeltaBits - 1
+)
+
+// MaxTargetZoneHeight is the largest time delta the hash layout can hold.
+const MaxTargetZoneHeight = hashDeltaMask
+
+// freqShift returns how far frequency bins are shifted right before packing.
+func (c Config) freqShift() uint {
+	maxBin := c.Bins() - 1
+	shift := uint(0)
+	for maxBin>>shift > hashFreqMask {
+		shift++
+	}
+	return shift
+}
+
+// packHash builds a version 2 hash for an anchor/target peak pair.
+func packHash(anchor, target Peak, shift uint) uint32 {
+	anchorFreq := uint32(anchor.Freq>>shift) & hashFreqMask
+	targetFreq := uint32(target.Freq>>shift) & hashFreqMask
+	timeDelta := uint32(target.Time-anchor.Time) & hashDeltaMask
+	return anchorFreq<<(hashFreqBits+hashDeltaBits) | targetFreq<<hashDeltaBits | timeDelta
+}
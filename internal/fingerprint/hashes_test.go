@@ -0,0 +1,111 @@
+package fingerprint
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// readPeaks reads a constellation map written one "time freq magnitude"
+// line per peak. testdata/peaks.txt holds the peaks of a few seconds of
+// gliding tones in noise under the default preset.
+func readPeaks(t *testing.T, path string) []Peak {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var peaks []Peak
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("%s: malformed line %q", path, line)
+		}
+		var p Peak
+		if p.Time, err = strconv.Atoi(fields[0]); err == nil {
+			if p.Freq, err = strconv.Atoi(fields[1]); err == nil {
+				p.Magnitude, err = strconv.ParseFloat(fields[2], 64)
+			}
+		}
+		if err != nil {
+			t.Fatalf("%s: line %q: %v", path, line, err)
+		}
+		peaks = append(peaks, p)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return peaks
+}
+
+// encodeHashes serializes hashes as little-endian (hash uint32, anchor time
+// float64 bits) records, so equal output means equal bytes.
+func encodeHashes(hashes []Hash) []byte {
+	buf := make([]byte, 0, 12*len(hashes))
+	for _, h := range hashes {
+		buf = binary.LittleEndian.AppendUint32(buf, h.Hash)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(h.AnchorTime))
+	}
+	return buf
+}
+
+// TestGenerateHashesGolden checks that the hashes of a fixed constellation
+// map are byte-identical to the committed golden file for any number of
+// workers. Run with -update to rewrite the golden files after an intended
+// change to hashing.
+func TestGenerateHashesGolden(t *testing.T) {
+	peaks := readPeaks(t, filepath.Join("testdata", "peaks.txt"))
+	byMagnitude := DefaultConfig()
+	byMagnitude.FanOutBy = FanOutByMagnitude
+	byMagnitude.FanOut = 3
+	for _, tc := range []struct {
+		golden string
+		cfg    Config
+	}{
+		{"hashes-default.golden", DefaultConfig()},
+		{"hashes-by-magnitude.golden", byMagnitude},
+	} {
+		path := filepath.Join("testdata", tc.golden)
+		single, err := generateHashes(peaks, tc.cfg, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := encodeHashes(single)
+		if *update {
+			if err := os.WriteFile(path, got, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: 1 worker: %d hashes differ from the golden file (%d bytes, want %d)", tc.golden, len(single), len(got), len(want))
+		}
+		for _, workers := range []int{2, 3, 8, 64} {
+			hashes, err := generateHashes(peaks, tc.cfg, workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encodeHashes(hashes), want) {
+				t.Errorf("%s: %d workers: output differs from the golden file", tc.golden, workers)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package fingerprint
+
+// The peak picker needs the maximum of every (2n+1)x(2n+1) box of the
+// spectrogram. A box maximum is separable: take the maximum along frequency
+// within each frame, then the maximum of those along time. Each 1D pass uses
+// the van Herk/Gil-Werman algorithm: the axis is split into blocks of 2n+1
+// positions, so every window spans at most two blocks and its maximum is the
+// larger of a block suffix maximum and a block prefix maximum. That costs
+// three comparisons per cell whatever the neighborhood size.
+
+// slidingMax sets dst[i] to the maximum of src[i-n..i+n], clipped to the
+// bounds of src. prefix and suffix are scratch space of len(src).
+func slidingMax(dst, src, prefix, suffix []float64, n int) {
+	k := 2*n + 1
+	m := len(src)
+	for start := 0; start < m; start += k {
+		end := start + k
+		if end > m {
+			end = m
+		}
+		prefix[start] = src[start]
+		for i := start + 1; i < end; i++ {
+			prefix[i] = maxOf(prefix[i-1], src[i])
+		}
+		suffix[end-1] = src[end-1]
+		for i := end - 2; i >= start; i-- {
+			suffix[i] = maxOf(suffix[i+1], src[i])
+		}
+	}
+	for i := range dst {
+		lo, hi := i-n, i+n
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > m-1 {
+			hi = m - 1
+		}
+		useSuffix, usePrefix := windowParts(lo, hi, k)
+		switch {
+		case useSuffix && usePrefix:
+			dst[i] = maxOf(suffix[lo], prefix[hi])
+		case usePrefix:
+			dst[i] = prefix[hi]
+		default:
+			dst[i] = suffix[lo]
+		}
+	}
+}
+
+// windowParts reports which block maxima cover the window [lo, hi] for blocks
+// of k positions: the suffix maximum at lo, the prefix maximum at hi, or both.
+// A window that fits in one block is either clipped at the block start, so
+// the prefix covers it, or clipped at the end of the data, where the last
+// block's suffix maxima stop.
+func windowParts(lo, hi, k int) (useSuffix, usePrefix bool) {
+	if lo/k != hi/k {
+		return true, true
+	}
+	if lo%k == 0 {
+		return false, true
+	}
+	return true, false
+}
+
+func maxOf(a, b float64) float64 {
+	if b > a {
+		return b
+	}
+	return a
+}
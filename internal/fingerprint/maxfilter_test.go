@@ -0,0 +1,149 @@
+package fingerprint
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// bruteForcePeaks is the peak scan ExtractPeaks used before the separable
+// max filter: compare every cell with its whole (2n+1)x(2n+1) neighborhood.
+func bruteForcePeaks(spectrogram [][]float64, n int) []Peak {
+	var peaks []Peak
+	for r := range spectrogram {
+		for c, v := range spectrogram[r] {
+			if v < minPeakMagnitude {
+				continue
+			}
+			isPeak := true
+			for nr := r - n; nr <= r+n && isPeak; nr++ {
+				if nr < 0 || nr >= len(spectrogram) {
+					continue
+				}
+				for nc := c - n; nc <= c+n; nc++ {
+					if nc < 0 || nc >= len(spectrogram[nr]) {
+						continue
+					}
+					if spectrogram[nr][nc] > v {
+						isPeak = false
+						break
+					}
+				}
+			}
+			if isPeak {
+				peaks = append(peaks, Peak{Time: r, Freq: c})
+			}
+		}
+	}
+	return peaks
+}
+
+// plainPeakConfig turns off everything but the local-maximum test, so that
+// ExtractPeaks must agree exactly with bruteForcePeaks.
+func plainPeakConfig(n int) Config {
+	cfg := DefaultConfig()
+	cfg.PeakNeighborhood = n
+	cfg.MinFreq, cfg.MaxFreq, cfg.MagnitudeScale = 0, 0, ScaleLinear
+	cfg.EnvelopeSeconds, cfg.ThresholdDB, cfg.FloorDB = 0, 0, 0
+	cfg.PeaksPerSecond, cfg.DensityBands = 0, 0
+	return cfg
+}
+
+// randomSpectrogram fills a frames x bins spectrogram with integers below
+// levels. Few levels give many ties and flat plateaus; many give distinct
+// values.
+func randomSpectrogram(rng *rand.Rand, frames, bins, levels int) [][]float64 {
+	s := make([][]float64, frames)
+	for i := range s {
+		s[i] = make([]float64, bins)
+		for j := range s[i] {
+			s[i][j] = float64(rng.Intn(levels))
+		}
+	}
+	return s
+}
+
+func TestSlidingMax(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 1; n <= 6; n++ {
+		for m := 1; m <= 4*(2*n+1)+1; m++ {
+			src := make([]float64, m)
+			for i := range src {
+				src[i] = float64(rng.Intn(10))
+			}
+			dst := make([]float64, m)
+			slidingMax(dst, src, make([]float64, m), make([]float64, m), n)
+			for i := range dst {
+				want := src[i]
+				for j := i - n; j <= i+n; j++ {
+					if j >= 0 && j < m && src[j] > want {
+						want = src[j]
+					}
+				}
+				if dst[i] != want {
+					t.Fatalf("n=%d len=%d: max at %d is %g, want %g (src %v)", n, m, i, dst[i], want, src)
+				}
+			}
+		}
+	}
+}
+
+// TestExtractPeaksMatchesBruteForce covers frame and bin counts on both
+// sides of multiples of the 2n+1 block size, so the partial final blocks and
+// the windows clipped at the edges of the spectrogram are all exercised.
+func TestExtractPeaksMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 3, 5, 10} {
+		for _, frames := range []int{0, 1, 2, 5, 11, 20, 21, 22, 23, 40, 63, 64, 100} {
+			for _, bins := range []int{1, 3, 7, 21, 50, 129} {
+				for _, levels := range []int{3, 1000} {
+					spec := randomSpectrogram(rng, frames, bins, levels)
+					got, err := ExtractPeaks(spec, plainPeakConfig(n))
+					if err != nil {
+						t.Fatalf("n=%d %dx%d: %v", n, frames, bins, err)
+					}
+					want := bruteForcePeaks(spec, n)
+					if len(got) != len(want) {
+						t.Fatalf("n=%d %dx%d levels=%d: %d peaks, want %d", n, frames, bins, levels, len(got), len(want))
+					}
+					for i := range got {
+						if got[i].Time != want[i].Time || got[i].Freq != want[i].Freq {
+							t.Fatalf("n=%d %dx%d levels=%d: peak %d at (%d, %d), want (%d, %d)",
+								n, frames, bins, levels, i, got[i].Time, got[i].Freq, want[i].Time, want[i].Freq)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkExtractPeaks runs over the spectrogram of a minute of gliding
+// tones in noise at the default window and hop, with every FFT bin kept.
+// Uniform random spectrograms flatter the brute-force scan, which gives up on
+// most cells after a comparison or two.
+func BenchmarkExtractPeaks(b *testing.B) {
+	cfg := plainPeakConfig(DefaultConfig().PeakNeighborhood)
+	rng := rand.New(rand.NewSource(1))
+	samples := make([]float64, 60*cfg.SampleRate)
+	for i := range samples {
+		t := float64(i) / float64(cfg.SampleRate)
+		samples[i] = 0.3*math.Sin(2*math.Pi*(440+200*math.Sin(t))*t) +
+			0.2*math.Sin(2*math.Pi*3000*t)*math.Sin(3*t) +
+			0.05*rng.NormFloat64()
+	}
+	spec, err := GenerateSpectogram(samples, cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("separable", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ExtractPeaks(spec, cfg)
+		}
+	})
+	b.Run("bruteforce", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			bruteForcePeaks(spec, cfg.PeakNeighborhood)
+		}
+	})
+}
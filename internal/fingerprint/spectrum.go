@@ -0,0 +1,143 @@
+package fingerprint
+
+import "math"
+
+// dbFloor is the level (dB relative to a unit FFT magnitude) that maps to 0
+// in dB-scaled spectrograms. Quieter bins are clamped to it, so dB values are
+// never negative and silence stays below every peak threshold.
+const dbFloor = -120.0
+
+// Magnitude scales
+const (
+	ScaleLinear = "linear"
+	ScaleDB     = "db"
+)
+
+// Frequency scales for grouping FFT bins into bands
+const (
+	FreqLinear = "linear"
+	FreqLog    = "log"
+	FreqMel    = "mel"
+)
+
+// fftBins is the number of FFT magnitudes per frame, DC to Nyquist.
+func (c Config) fftBins() int {
+	return c.WindowSize/2 + 1
+}
+
+// binHz is the frequency spacing of FFT bins.
+func (c Config) binHz() float64 {
+	return float64(c.SampleRate) / float64(c.WindowSize)
+}
+
+// Bins returns the number of values in each spectrogram frame once the band
+// of interest and bin grouping have been applied. Peak frequencies index
+// into these values.
+func (c Config) Bins() int {
+	return len(c.bandEdges()) - 1
+}
+
+// bandEdges returns the FFT bin boundaries of the spectrogram's output bins:
+// output bin i covers FFT bins [edges[i], edges[i+1]).
+func (c Config) bandEdges() []int {
+	lo, hi := 0, c.fftBins()
+	if c.MinFreq > 0 {
+		lo = int(math.Ceil(c.MinFreq / c.binHz()))
+	}
+	if c.MaxFreq > 0 {
+		hi = int(math.Floor(c.MaxFreq/c.binHz())) + 1
+	}
+	if hi > c.fftBins() {
+		hi = c.fftBins()
+	}
+	if lo >= hi {
+		return []int{lo}
+	}
+
+	var toScale, fromScale func(float64) float64
+	switch c.FreqScale {
+	case FreqLog:
+		toScale, fromScale = math.Log, math.Exp
+	case FreqMel:
+		toScale = func(f float64) float64 { return 2595 * math.Log10(1+f/700) }
+		fromScale = func(m float64) float64 { return 700 * (math.Pow(10, m/2595) - 1) }
+	default:
+		edges := make([]int, 0, hi-lo+1)
+		for b := lo; b <= hi; b++ {
+			edges = append(edges, b)
+		}
+		return edges
+	}
+
+	// Space the band edges evenly on the chosen scale. Low bands narrower
+	// than an FFT bin are merged, so there may be fewer than FreqBands.
+	// The log scale can't start at DC, so it starts at the first bin.
+	fLo := float64(lo) * c.binHz()
+	if c.FreqScale == FreqLog && lo == 0 {
+		fLo = c.binHz()
+	}
+	sLo, sHi := toScale(fLo), toScale(float64(hi)*c.binHz())
+	edges := []int{lo}
+	for i := 1; i < c.FreqBands; i++ {
+		f := fromScale(sLo + (sHi-sLo)*float64(i)/float64(c.FreqBands))
+		b := int(math.Round(f / c.binHz()))
+		if b > edges[len(edges)-1] && b < hi {
+			edges = append(edges, b)
+		}
+	}
+	return append(edges, hi)
+}
+
+// spectrumShaper turns raw FFT magnitudes into spectrogram frames: it keeps
+// the band of interest, groups bins and optionally converts to dB.
+type spectrumShaper struct {
+	edges   []int
+	grouped bool
+	db      bool
+}
+
+func newSpectrumShaper(cfg Config) *spectrumShaper {
+	return &spectrumShaper{
+		edges:   cfg.bandEdges(),
+		grouped: cfg.FreqScale == FreqLog || cfg.FreqScale == FreqMel,
+		db:      cfg.MagnitudeScale == ScaleDB,
+	}
+}
+
+// identity reports whether frames pass through unchanged.
+func (s *spectrumShaper) identity(fftBins int) bool {
+	return !s.grouped && !s.db && s.edges[0] == 0 && s.edges[len(s.edges)-1] == fftBins
+}
+
+// shape returns a new spectrogram frame for one frame of FFT magnitudes.
+// Grouped bins carry the RMS magnitude of the FFT bins they cover.
+func (s *spectrumShaper) shape(magnitudes []float64) []float64 {
+	if s.identity(len(magnitudes)) {
+		return append([]float64(nil), magnitudes...)
+	}
+	out := make([]float64, len(s.edges)-1)
+	for i := range out {
+		lo, hi := s.edges[i], s.edges[i+1]
+		if s.grouped {
+			power := 0.0
+			for _, m := range magnitudes[lo:hi] {
+				power += m * m
+			}
+			out[i] = math.Sqrt(power / float64(hi-lo))
+		} else {
+			out[i] = magnitudes[lo]
+		}
+		if s.db {
+			out[i] = toDB(out[i])
+		}
+	}
+	return out
+}
+
+// toDB converts a magnitude to dB above dbFloor.
+func toDB(m float64) float64 {
+	if m <= 0 {
+		return 0
+	}
+	return maxOf(20*math.Log10(m)-dbFloor, 0)
+}
@@ -0,0 +1,335 @@
+package matcher
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// boltDBFile is the file name of a BoltStore inside the data directory.
+const boltDBFile = "fingerprints.bolt"
+
+// Buckets of a BoltStore:
+//
+//	hashes       hash (4 bytes) + songID (4 bytes) -> anchor times (8 bytes each)
+//	song-hashes  songID -> the distinct hashes of the song (4 bytes each)
+//	songs        songID -> song JSON (a bare song name in databases from
+//	             before songs had more than a name)
+//	meta         "config" -> fingerprint config JSON, "hashVersion" -> uint32,
+//	             "songs", "entries" and "uniqueHashes" -> uint64 counters
+//
+// All integers are big-endian so keys sort numerically and every occurrence
+// of a hash is one contiguous key range.
+var (
+	hashesBucket     = []byte("hashes")
+	songHashesBucket = []byte("song-hashes")
+	songsBucket      = []byte("songs")
+	metaBucket       = []byte("meta")
+
+	configKey       = []byte("config")
+	hashVersionKey  = []byte("hashVersion")
+	songCountKey    = []byte("songs")
+	entriesKey      = []byte("entries")
+	uniqueHashesKey = []byte("uniqueHashes")
+)
+
+// BoltStore keeps the fingerprint index in an embedded bbolt database, so
+// lookups read only the pages they need and nothing is loaded up front.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the bolt database in dir. bbolt locks the
+// file, so only one process can have it open at a time.
+func NewBoltStore(dir string) (*BoltStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, boltDBFile)
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{hashesBucket, songHashesBucket, songsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(metaBucket)
+		// Databases from before the song counter count their songs once
+		if meta.Get(songCountKey) == nil {
+			n := uint64(tx.Bucket(songsBucket).Stats().KeyN)
+			if err := putCounter(meta, songCountKey, n); err != nil {
+				return err
+			}
+		}
+		v := meta.Get(hashVersionKey)
+		if v == nil {
+			return meta.Put(hashVersionKey, binary.BigEndian.AppendUint32(nil, fingerprint.HashVersion))
+		}
+		if version := binary.BigEndian.Uint32(v); version != fingerprint.HashVersion {
+			return fmt.Errorf("%s uses hash layout v%d, but this build writes v%d", path, version, fingerprint.HashVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) PutSong(song Song, hashes []fingerprint.Hash) error {
+	songID := song.ID
+	songJSON, err := json.Marshal(song)
+	if err != nil {
+		return err
+	}
+	// Group the occurrences of each hash so each key is written once
+	times := make(map[uint32][]float64)
+	var order []uint32
+	for _, h := range hashes {
+		if _, ok := times[h.Hash]; !ok {
+			order = append(order, h.Hash)
+		}
+		times[h.Hash] = append(times[h.Hash], h.AnchorTime)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteSong(tx, songID); err != nil {
+			return err
+		}
+
+		index := tx.Bucket(hashesBucket)
+		meta := tx.Bucket(metaBucket)
+		entries, unique := getCounter(meta, entriesKey), getCounter(meta, uniqueHashesKey)
+
+		songHashes := make([]byte, 0, len(order)*4)
+		for _, hash := range order {
+			if !hasHash(index, hash) {
+				unique++
+			}
+			var value []byte
+			for _, t := range times[hash] {
+				value = binary.BigEndian.AppendUint64(value, math.Float64bits(t))
+			}
+			if err := index.Put(hashKey(hash, songID), value); err != nil {
+				return err
+			}
+			entries += uint64(len(times[hash]))
+			songHashes = binary.BigEndian.AppendUint32(songHashes, hash)
+		}
+
+		id := songKey(songID)
+		if err := tx.Bucket(songHashesBucket).Put(id, songHashes); err != nil {
+			return err
+		}
+		if tx.Bucket(songsBucket).Get(id) == nil {
+			if err := putCounter(meta, songCountKey, getCounter(meta, songCountKey)+1); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(songsBucket).Put(id, songJSON); err != nil {
+			return err
+		}
+		if err := putCounter(meta, entriesKey, entries); err != nil {
+			return err
+		}
+		return putCounter(meta, uniqueHashesKey, unique)
+	})
+}
+
+func (s *BoltStore) Lookup(hash uint32) ([]Match, error) {
+	var matches []Match
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := binary.BigEndian.AppendUint32(nil, hash)
+		c := tx.Bucket(hashesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && hashOf(k) == hash; k, v = c.Next() {
+			songID := int(binary.BigEndian.Uint32(k[4:]))
+			for i := 0; i+8 <= len(v); i += 8 {
+				matches = append(matches, Match{
+					SongID:    songID,
+					Timestamp: math.Float64frombits(binary.BigEndian.Uint64(v[i:])),
+				})
+			}
+		}
+		return nil
+	})
+	return matches, err
+}
+
+func (s *BoltStore) ForEach(fn func(hash uint32, m Match) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashesBucket).ForEach(func(k, v []byte) error {
+			hash, songID := hashOf(k), int(binary.BigEndian.Uint32(k[4:]))
+			for i := 0; i+8 <= len(v); i += 8 {
+				m := Match{SongID: songID, Timestamp: math.Float64frombits(binary.BigEndian.Uint64(v[i:]))}
+				if err := fn(hash, m); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (s *BoltStore) Song(songID int) (song Song, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(songsBucket).Get(songKey(songID)); v != nil {
+			song, ok = decodeBoltSong(songID, v), true
+		}
+		return nil
+	})
+	return song, ok, err
+}
+
+func (s *BoltStore) Songs() (map[int]Song, error) {
+	songs := make(map[int]Song)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(songsBucket).ForEach(func(k, v []byte) error {
+			songID := int(binary.BigEndian.Uint32(k))
+			songs[songID] = decodeBoltSong(songID, v)
+			return nil
+		})
+	})
+	return songs, err
+}
+
+func (s *BoltStore) DeleteSong(songID int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteSong(tx, songID)
+	})
+}
+
+func (s *BoltStore) Stats() (Stats, error) {
+	var stats Stats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		stats.Songs = int(getCounter(meta, songCountKey))
+		stats.UniqueHashes = int(getCounter(meta, uniqueHashesKey))
+		stats.Entries = int(getCounter(meta, entriesKey))
+		return nil
+	})
+	return stats, err
+}
+
+func (s *BoltStore) LoadConfig() (fingerprint.Config, bool, error) {
+	var cfg fingerprint.Config
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(metaBucket).Get(configKey)
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &cfg)
+	})
+	return cfg, ok, err
+}
+
+func (s *BoltStore) SaveConfig(cfg fingerprint.Config) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(configKey, data)
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func songKey(songID int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(songID))
+}
+
+func hashKey(hash uint32, songID int) []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, hash), uint32(songID))
+}
+
+func hashOf(key []byte) uint32 {
+	return binary.BigEndian.Uint32(key)
+}
+
+// deleteSong removes a song and its hashes within tx, if it is stored.
+func deleteSong(tx *bolt.Tx, songID int) error {
+	id := songKey(songID)
+	songHashes := tx.Bucket(songHashesBucket).Get(id)
+	if songHashes == nil {
+		return nil
+	}
+
+	index := tx.Bucket(hashesBucket)
+	meta := tx.Bucket(metaBucket)
+	entries, unique := getCounter(meta, entriesKey), getCounter(meta, uniqueHashesKey)
+	for i := 0; i+4 <= len(songHashes); i += 4 {
+		hash := binary.BigEndian.Uint32(songHashes[i:])
+		key := hashKey(hash, songID)
+		entries -= uint64(len(index.Get(key)) / 8)
+		if err := index.Delete(key); err != nil {
+			return err
+		}
+		if !hasHash(index, hash) {
+			unique--
+		}
+	}
+
+	if err := tx.Bucket(songHashesBucket).Delete(id); err != nil {
+		return err
+	}
+	if tx.Bucket(songsBucket).Get(id) != nil {
+		if err := putCounter(meta, songCountKey, getCounter(meta, songCountKey)-1); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(songsBucket).Delete(id); err != nil {
+		return err
+	}
+	if err := putCounter(meta, entriesKey, entries); err != nil {
+		return err
+	}
+	return putCounter(meta, uniqueHashesKey, unique)
+}
+
+// decodeBoltSong decodes a value of the songs bucket.
+func decodeBoltSong(songID int, v []byte) Song {
+	var song Song
+	if len(v) == 0 || v[0] != '{' || json.Unmarshal(v, &song) != nil {
+		song = Song{Title: string(v)}
+	}
+	song.ID = songID
+	return song
+}
+
+// hasHash reports whether any song has an occurrence of hash.
+func hasHash(index *bolt.Bucket, hash uint32) bool {
+	k, _ := index.Cursor().Seek(binary.BigEndian.AppendUint32(nil, hash))
+	return k != nil && hashOf(k) == hash
+}
+
+func getCounter(meta *bolt.Bucket, key []byte) uint64 {
+	v := meta.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putCounter(meta *bolt.Bucket, key []byte, n uint64) error {
+	return meta.Put(key, binary.BigEndian.AppendUint64(nil, n))
+}
@@ -0,0 +1,57 @@
+package matcher
+
+import (
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// TestBoltStoreSongCounter checks that the song count kept in the meta
+// bucket follows adds, re-adds and deletes, and is rebuilt for databases
+// written before it existed.
+func TestBoltStoreSongCounter(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBoltStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCount := func(want int) {
+		t.Helper()
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Songs != want {
+			t.Fatalf("Stats reports %d songs, want %d", stats.Songs, want)
+		}
+	}
+	for songID := 1; songID <= 3; songID++ {
+		if err := s.PutSong(Song{ID: songID}, randomHashes(int64(songID), 50)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PutSong(Song{ID: 2}, randomHashes(20, 50)); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(3)
+	if err := s.DeleteSong(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSong(1); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(2)
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Delete(songCountKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if s, err = NewBoltStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkCount(2)
+}
@@ -0,0 +1,382 @@
+package matcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// The catalog (catalog.db) holds every song's metadata and hashes in one
+// append-only file:
+//
+//	header   magic "SHZC", format version, hash layout version, config
+//	         length (uint32 each), fingerprint config JSON (empty if none),
+//	         CRC-32C of everything before it (uint32)
+//	entries  payload length, CRC-32C of the length, CRC-32C of the payload
+//	         (uint32 each), payload
+//
+// An entry payload is an operation byte and a song ID (uint32), followed for
+// a put by the song metadata (uint32 length, JSON) and its hash occurrences
+// (hash uint32, anchor time float64). A put replaces any earlier entry of the
+// song and a delete removes it, so the last entry of each song wins.
+//
+// Each change is one entry written with a single append and synced, so a
+// song's metadata and hashes are committed together. After a crash at most
+// the last entry is incomplete or fails its checksum; it is dropped on the
+// next load. The length has its own checksum, so a damaged length is
+// reported as corruption rather than mistaken for the end of the file.
+// All integers are little-endian.
+const (
+	catalogMagic         = "SHZC"
+	catalogFormatVersion = 1
+
+	fileHeaderFixedSize = 16
+	frameHeaderSize     = 12
+	postingSize         = 12
+
+	// maxConfigSize bounds the config length read from a header, so a
+	// corrupt length can't cause a huge allocation
+	maxConfigSize = 1 << 16
+)
+
+// Catalog entry operations
+const (
+	entryPut    = 1
+	entryDelete = 2
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornBatch reports an entry cut short or garbled by a crash mid-write.
+var errTornBatch = errors.New("torn batch")
+
+// songMeta is the JSON stored with each song. Entries written before songs
+// had more than a name only hold "name", which is read as the title.
+type songMeta struct {
+	Song
+	Name string `json:"name,omitempty"`
+}
+
+// catalogEntry is one decoded catalog entry.
+type catalogEntry struct {
+	op     byte
+	songID int
+	song   Song
+	hashes []fingerprint.Hash
+}
+
+// fileHeader describes a catalog header.
+type fileHeader struct {
+	config    fingerprint.Config
+	hasConfig bool
+	// size is the length of the header in bytes
+	size int64
+}
+
+// appendFileHeader encodes a header onto buf.
+func appendFileHeader(buf []byte, magic string, format uint32, cfg fingerprint.Config, hasConfig bool) ([]byte, error) {
+	var cfgJSON []byte
+	if hasConfig {
+		var err error
+		if cfgJSON, err = json.Marshal(cfg); err != nil {
+			return nil, err
+		}
+	}
+	start := len(buf)
+	buf = append(buf, magic...)
+	buf = binary.LittleEndian.AppendUint32(buf, format)
+	buf = binary.LittleEndian.AppendUint32(buf, fingerprint.HashVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(cfgJSON)))
+	buf = append(buf, cfgJSON...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf[start:], crcTable)), nil
+}
+
+// readCatalogHeader reads the header of the catalog at path. It returns
+// io.EOF for an empty file.
+// It checks the header against the current hash layout.
+func readCatalogHeader(r io.Reader, path string) (fileHeader, error) {
+	fixed := make([]byte, fileHeaderFixedSize)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		if err == io.EOF {
+			return fileHeader{}, io.EOF
+		}
+		return fileHeader{}, fmt.Errorf("%s: truncated header", path)
+	}
+	if string(fixed[:len(catalogMagic)]) != catalogMagic {
+		return fileHeader{}, fmt.Errorf("%s is not a song catalog", path)
+	}
+	if format := binary.LittleEndian.Uint32(fixed[len(catalogMagic):]); format != catalogFormatVersion {
+		return fileHeader{}, fmt.Errorf("%s has unknown format v%d", path, format)
+	}
+	cfgLen := binary.LittleEndian.Uint32(fixed[12:])
+	if cfgLen > maxConfigSize {
+		return fileHeader{}, fmt.Errorf("%s: corrupt header", path)
+	}
+	rest := make([]byte, cfgLen+4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return fileHeader{}, fmt.Errorf("%s: truncated header", path)
+	}
+	cfgJSON := rest[:cfgLen]
+	crc := crc32.Update(crc32.Checksum(fixed, crcTable), crcTable, cfgJSON)
+	if crc != binary.LittleEndian.Uint32(rest[cfgLen:]) {
+		return fileHeader{}, fmt.Errorf("%s: header checksum mismatch", path)
+	}
+
+	if version := binary.LittleEndian.Uint32(fixed[8:]); version != fingerprint.HashVersion {
+		return fileHeader{}, fmt.Errorf("%s uses hash layout v%d, but this build writes v%d", path, version, fingerprint.HashVersion)
+	}
+	h := fileHeader{size: int64(fileHeaderFixedSize) + int64(cfgLen) + 4}
+	if cfgLen > 0 {
+		if err := json.Unmarshal(cfgJSON, &h.config); err != nil {
+			return fileHeader{}, fmt.Errorf("%s: bad fingerprint config in header: %v", path, err)
+		}
+		h.hasConfig = true
+	}
+	return h, nil
+}
+
+// appendFrame appends a frame whose payload is written by fill, then fills
+// in its length and checksums.
+func appendFrame(buf []byte, fill func(buf []byte) []byte) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, frameHeaderSize)...)
+	buf = fill(buf)
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start-frameHeaderSize))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.Checksum(buf[start:start+4], crcTable))
+	binary.LittleEndian.PutUint32(buf[start+8:], crc32.Checksum(buf[start+frameHeaderSize:], crcTable))
+	return buf
+}
+
+// readFrames calls fn with the payload of every frame in a file of size
+// bytes, starting at offset start. The payload is only valid during the call.
+// It returns the offset just past the last intact frame.
+//
+// If the file ends with a torn frame the error is errTornBatch. A frame is
+// torn only if it is the last one and is incomplete: its header is cut
+// short or zero-filled up to the end of the file, or its header checks out
+// but its payload runs past the end or fails its checksum right at the end.
+// Any other damaged frame, including a bad length, is reported as
+// corruption.
+func readFrames(r *bufio.Reader, start, size int64, fn func(payload []byte) error) (int64, error) {
+	end := start
+	header := make([]byte, frameHeaderSize)
+	var payload []byte
+	for end < size {
+		if end+frameHeaderSize > size {
+			return end, errTornBatch
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			return end, err
+		}
+		if crc32.Checksum(header[:4], crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			// A crash after the file grew can leave zeros where the
+			// last frame should be
+			if isZero(header) {
+				zero, err := restIsZero(r)
+				if err != nil {
+					return end, err
+				}
+				if zero {
+					return end, errTornBatch
+				}
+			}
+			return end, fmt.Errorf("corrupt entry header at offset %d", end)
+		}
+		length := int64(binary.LittleEndian.Uint32(header))
+		next := end + frameHeaderSize + length
+		if next > size {
+			return end, errTornBatch
+		}
+		// Every frame has a payload
+		if length == 0 {
+			return end, fmt.Errorf("corrupt entry at offset %d", end)
+		}
+		if int64(cap(payload)) < length {
+			payload = make([]byte, length)
+		}
+		payload = payload[:length]
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return end, err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[8:]) {
+			if next == size {
+				return end, errTornBatch
+			}
+			return end, fmt.Errorf("corrupt entry at offset %d", end)
+		}
+		if err := fn(payload); err != nil {
+			return end, fmt.Errorf("bad entry at offset %d: %v", end, err)
+		}
+		end = next
+	}
+	return end, nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// restIsZero reports whether everything left in r is zero.
+func restIsZero(r *bufio.Reader) (bool, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if !isZero(buf[:n]) {
+			return false, nil
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// appendEntry encodes a catalog entry frame onto buf.
+func appendEntry(buf []byte, e catalogEntry) ([]byte, error) {
+	var metaJSON []byte
+	if e.op == entryPut {
+		var err error
+		if metaJSON, err = json.Marshal(songMeta{Song: e.song}); err != nil {
+			return nil, err
+		}
+	}
+	return appendFrame(buf, func(buf []byte) []byte {
+		buf = append(buf, e.op)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(e.songID))
+		if e.op != entryPut {
+			return buf
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(metaJSON)))
+		buf = append(buf, metaJSON...)
+		for _, h := range e.hashes {
+			buf = binary.LittleEndian.AppendUint32(buf, h.Hash)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(h.AnchorTime))
+		}
+		return buf
+	}), nil
+}
+
+// decodeEntry decodes a catalog entry payload.
+func decodeEntry(payload []byte) (catalogEntry, error) {
+	if len(payload) < 5 {
+		return catalogEntry{}, errors.New("short entry")
+	}
+	e := catalogEntry{op: payload[0], songID: normalizeSongID(int(binary.LittleEndian.Uint32(payload[1:])))}
+	payload = payload[5:]
+	switch e.op {
+	case entryDelete:
+		return e, nil
+	case entryPut:
+	default:
+		return catalogEntry{}, fmt.Errorf("unknown operation %d", e.op)
+	}
+
+	if len(payload) < 4 {
+		return catalogEntry{}, errors.New("short entry")
+	}
+	metaLen := int(binary.LittleEndian.Uint32(payload))
+	payload = payload[4:]
+	if metaLen > len(payload) || (len(payload)-metaLen)%postingSize != 0 {
+		return catalogEntry{}, errors.New("bad entry length")
+	}
+	var meta songMeta
+	if err := json.Unmarshal(payload[:metaLen], &meta); err != nil {
+		return catalogEntry{}, fmt.Errorf("bad song metadata: %v", err)
+	}
+	e.song = meta.Song
+	e.song.ID = e.songID
+	if e.song.Title == "" {
+		e.song.Title = meta.Name
+	}
+	payload = payload[metaLen:]
+	e.hashes = make([]fingerprint.Hash, 0, len(payload)/postingSize)
+	for ; len(payload) >= postingSize; payload = payload[postingSize:] {
+		e.hashes = append(e.hashes, fingerprint.Hash{
+			Hash:       binary.LittleEndian.Uint32(payload),
+			AnchorTime: math.Float64frombits(binary.LittleEndian.Uint64(payload[4:])),
+		})
+	}
+	return e, nil
+}
+
+// readCatalog reads the catalog in file and returns its header, the live
+// put entry of every song and the offset just past the last intact entry.
+// If the file ends with a torn entry, the results are returned with
+// errTornBatch.
+func readCatalog(file *os.File) (fileHeader, map[int]catalogEntry, int64, error) {
+	live := make(map[int]catalogEntry)
+	info, err := file.Stat()
+	if err != nil {
+		return fileHeader{}, nil, 0, err
+	}
+	r := bufio.NewReader(file)
+	h, err := readCatalogHeader(r, file.Name())
+	if err == io.EOF {
+		return fileHeader{}, live, 0, nil // Empty file
+	}
+	if err != nil {
+		return fileHeader{}, nil, 0, err
+	}
+
+	end, err := readFrames(r, h.size, info.Size(), func(payload []byte) error {
+		e, err := decodeEntry(payload)
+		if err != nil {
+			return err
+		}
+		if e.op == entryDelete {
+			delete(live, e.songID)
+		} else {
+			live[e.songID] = e
+		}
+		return nil
+	})
+	if err != nil && err != errTornBatch {
+		return fileHeader{}, nil, 0, fmt.Errorf("%s: %v", file.Name(), err)
+	}
+	return h, live, end, err
+}
+
+// writeCatalogFile atomically replaces the catalog at path with one holding
+// a put entry per song, and returns its size.
+func writeCatalogFile(path string, cfg fingerprint.Config, hasConfig bool, live map[int]catalogEntry) (int64, error) {
+	header, err := appendFileHeader(nil, catalogMagic, catalogFormatVersion, cfg, hasConfig)
+	if err != nil {
+		return 0, err
+	}
+	songIDs := make([]int, 0, len(live))
+	for songID := range live {
+		songIDs = append(songIDs, songID)
+	}
+	sort.Ints(songIDs)
+
+	size := int64(len(header))
+	err = writeFileAtomic(path, func(w *bufio.Writer) error {
+		w.Write(header)
+		var buf []byte
+		for _, songID := range songIDs {
+			if buf, err = appendEntry(buf[:0], live[songID]); err != nil {
+				return err
+			}
+			w.Write(buf)
+			size += int64(len(buf))
+		}
+		return nil
+	})
+	return size, err
+}
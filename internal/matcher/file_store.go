@@ -0,0 +1,412 @@
+package matcher
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// FileStore keeps the whole index in memory and persists songs, their
+// hashes and the fingerprint config to an append-only catalog (catalog.db)
+// in one directory. Replaced and deleted songs leave dead entries in the
+// catalog until it is compacted.
+//
+// Processes sharing the directory take an advisory lock on its LOCK file
+// around every load and write, so concurrent writers can't interleave.
+// A store does not see songs other processes add after it loaded.
+type FileStore struct {
+	mu          sync.RWMutex
+	dir         string
+	catalogPath string
+	lockPath    string
+	index       map[uint32][]Match
+	songs       map[int]Song
+	// config is the fingerprint config recorded in the catalog header
+	config    fingerprint.Config
+	hasConfig bool
+	// tailInfo identifies the catalog file as of this store's last load or
+	// append, and tailEnd is the offset just past its last entry then.
+	// Entries before tailEnd are known intact; nil means the whole file
+	// must be checked before appending.
+	tailInfo os.FileInfo
+	tailEnd  int64
+}
+
+// NewFileStore opens the store in dir, loading any existing catalog. An
+// entry torn by a crash at the end of the catalog is truncated, and a
+// database from before the catalog (hashes.db, songs.json, config.json) is
+// migrated into one. The directory is created on the first write. If
+// loading fails the error is returned together with an empty store, which
+// can still be written to unless the catalog is incompatible.
+func NewFileStore(dir string) (*FileStore, error) {
+	s := &FileStore{
+		dir:         dir,
+		catalogPath: filepath.Join(dir, catalogDBFile),
+		lockPath:    filepath.Join(dir, lockFileName),
+	}
+	err := s.load()
+	if err != nil {
+		s.index = make(map[uint32][]Match)
+		s.songs = make(map[int]Song)
+	}
+	return s, err
+}
+
+func (s *FileStore) load() error {
+	s.index = make(map[uint32][]Match)
+	s.songs = make(map[int]Song)
+	if _, err := os.Stat(s.dir); os.IsNotExist(err) {
+		return nil
+	}
+	// A directory we can't create the lock file in can't be written by us
+	// either; it can still be read
+	if unlock, err := lockFile(s.lockPath); err == nil {
+		defer unlock()
+	}
+
+	file, err := os.Open(s.catalogPath)
+	if os.IsNotExist(err) {
+		return s.migrateLegacyFiles()
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	h, live, end, err := readCatalog(file)
+	if err == errTornBatch {
+		if err := truncateFile(s.catalogPath, end); err != nil {
+			return fmt.Errorf("failed to drop incomplete write at the end of %s: %v", s.catalogPath, err)
+		}
+		fmt.Printf("Warning: %s ended with an incomplete write, which was dropped\n", s.catalogPath)
+	} else if err != nil {
+		return err
+	}
+	s.config, s.hasConfig = h.config, h.hasConfig
+	s.setSongs(live)
+	if info, err := file.Stat(); err == nil {
+		s.tailInfo, s.tailEnd = info, end
+	}
+	return nil
+}
+
+// checkMigrated refuses to start a catalog next to a database from before
+// the catalog that could not be migrated, which would hide its songs.
+func (s *FileStore) checkMigrated() error {
+	if _, err := os.Stat(s.catalogPath); !os.IsNotExist(err) || !hasLegacyFiles(s.dir) {
+		return nil
+	}
+	return fmt.Errorf("%s holds a database that could not be migrated to %s; move %s, %s and %s away to start a new one", s.dir, catalogDBFile, hashesDBFile, songsDBFile, configDBFile)
+}
+
+// migrateLegacyFiles converts a database from before the catalog, if dir
+// holds one. The old files are left in place.
+func (s *FileStore) migrateLegacyFiles() error {
+	if !hasLegacyFiles(s.dir) {
+		return nil
+	}
+	cfg, hasConfig, live, err := readLegacyFiles(s.dir)
+	if err != nil {
+		return err
+	}
+	if _, err := writeCatalogFile(s.catalogPath, cfg, hasConfig, live); err != nil {
+		return fmt.Errorf("failed to migrate to %s: %v", s.catalogPath, err)
+	}
+	fmt.Printf("Migrated %s, %s and %s into %s; the old files are no longer used\n", hashesDBFile, songsDBFile, configDBFile, s.catalogPath)
+	s.config, s.hasConfig = cfg, hasConfig
+	s.setSongs(live)
+	return nil
+}
+
+// setSongs indexes the live entry of every song.
+func (s *FileStore) setSongs(live map[int]catalogEntry) {
+	songIDs := make([]int, 0, len(live))
+	for songID := range live {
+		songIDs = append(songIDs, songID)
+	}
+	sort.Ints(songIDs)
+	for _, songID := range songIDs {
+		e := live[songID]
+		s.songs[songID] = e.song
+		addToIndex(s.index, songID, e.hashes)
+	}
+}
+
+func (s *FileStore) PutSong(song Song, hashes []fingerprint.Hash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := catalogEntry{op: entryPut, songID: song.ID, song: song, hashes: hashes}
+	if err := s.appendEntry(e); err != nil {
+		return fmt.Errorf("failed to save song: %v", err)
+	}
+	if _, ok := s.songs[song.ID]; ok {
+		removeFromIndex(s.index, song.ID)
+	}
+	s.songs[song.ID] = song
+	addToIndex(s.index, song.ID, hashes)
+	return nil
+}
+
+func (s *FileStore) Lookup(hash uint32) ([]Match, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index[hash], nil
+}
+
+func (s *FileStore) ForEach(fn func(hash uint32, m Match) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return forEachInIndex(s.index, fn)
+}
+
+func (s *FileStore) Song(songID int) (Song, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	song, ok := s.songs[songID]
+	return song, ok, nil
+}
+
+func (s *FileStore) Songs() (map[int]Song, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copySongs(s.songs), nil
+}
+
+// DeleteSong appends a delete entry for the song to the catalog.
+func (s *FileStore) DeleteSong(songID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.songs[songID]; !ok {
+		return nil
+	}
+	if err := s.appendEntry(catalogEntry{op: entryDelete, songID: songID}); err != nil {
+		return fmt.Errorf("failed to delete song: %v", err)
+	}
+	delete(s.songs, songID)
+	removeFromIndex(s.index, songID)
+	return nil
+}
+
+func (s *FileStore) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return indexStats(s.index, s.songs), nil
+}
+
+// LoadConfig returns the fingerprint configuration recorded in the catalog
+func (s *FileStore) LoadConfig() (fingerprint.Config, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config, s.hasConfig, nil
+}
+
+// SaveConfig records the fingerprint configuration in the catalog header,
+// rewriting the catalog if it was made with another config. It fails if
+// the catalog holds songs made with another config, which another process
+// may have added since this store loaded.
+func (s *FileStore) SaveConfig(cfg fingerprint.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.checkMigrated(); err != nil {
+		return err
+	}
+	file, err := os.Open(s.catalogPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	live := make(map[int]catalogEntry)
+	if err == nil {
+		h, entries, _, err := readCatalog(file)
+		file.Close()
+		if err != nil && err != errTornBatch {
+			return err
+		}
+		if h.hasConfig && h.config == cfg {
+			s.config, s.hasConfig = cfg, true
+			return nil
+		}
+		// Catalogs that don't record a config were made with the default
+		old := fingerprint.DefaultConfig()
+		if h.hasConfig {
+			old = h.config
+		}
+		if len(entries) > 0 && old != cfg {
+			return fmt.Errorf("%s holds songs fingerprinted with config %q, not %q", s.catalogPath, old.Name, cfg.Name)
+		}
+		live = entries
+	}
+	s.tailInfo = nil
+	if _, err := writeCatalogFile(s.catalogPath, cfg, true, live); err != nil {
+		return err
+	}
+	s.config, s.hasConfig = cfg, true
+	return nil
+}
+
+// Compact rewrites the catalog with only the live entry of each song,
+// dropping replaced and deleted songs. The new file is synced and renamed
+// over the old one, so a process loading the database meanwhile reads one
+// or the other in full. Lookups continue during compaction; writes wait for
+// it.
+func (s *FileStore) Compact() (CompactStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	unlock, err := s.lock()
+	if err != nil {
+		return CompactStats{}, err
+	}
+	defer unlock()
+
+	file, err := os.Open(s.catalogPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return CompactStats{}, nil
+		}
+		return CompactStats{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return CompactStats{}, err
+	}
+
+	// The catalog is re-read rather than written from memory so songs other
+	// processes added are kept; a torn entry at the end is dropped
+	h, live, _, err := readCatalog(file)
+	if err != nil && err != errTornBatch {
+		return CompactStats{}, err
+	}
+	size, err := writeCatalogFile(s.catalogPath, h.config, h.hasConfig, live)
+	if err != nil {
+		return CompactStats{}, err
+	}
+	return CompactStats{BytesBefore: info.Size(), BytesAfter: size}, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// lock creates the directory if needed and takes the cross-process lock.
+func (s *FileStore) lock() (func(), error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(s.lockPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot lock database: %v", err)
+	}
+	return unlock, nil
+}
+
+// appendEntry appends one entry to the catalog under the cross-process lock
+// and syncs it, creating the catalog if needed
+func (s *FileStore) appendEntry(e catalogEntry) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.checkMigrated(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.catalogPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Until this append succeeds, the end of the file is unknown
+	s.tailInfo = nil
+	var buf []byte
+	end := int64(0)
+	if info.Size() == 0 {
+		if buf, err = appendFileHeader(nil, catalogMagic, catalogFormatVersion, s.config, s.hasConfig); err != nil {
+			return err
+		}
+	} else if end, err = s.intactEnd(file, info); err != nil {
+		return err
+	}
+
+	if buf, err = appendEntry(buf, e); err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	s.tailInfo, s.tailEnd = info, end+int64(len(buf))
+	return nil
+}
+
+// intactEnd returns the offset just past the last intact entry of the
+// catalog open in file. Entries up to tailEnd are trusted, so only what
+// other processes appended since is read. A torn entry at the end, left by
+// a writer that crashed, is truncated; otherwise the next entry would land
+// after it and be dropped with it on the next load.
+func (s *FileStore) intactEnd(file *os.File, info os.FileInfo) (int64, error) {
+	size := info.Size()
+	start := s.tailEnd
+	if s.tailInfo == nil || !os.SameFile(s.tailInfo, info) || size < start {
+		// Replaced or never read by this store. Never append to a file
+		// holding hashes in another layout or made with another config.
+		h, err := readCatalogHeader(io.NewSectionReader(file, 0, size), s.catalogPath)
+		if err != nil {
+			return 0, err
+		}
+		if h.hasConfig != s.hasConfig || h.config != s.config {
+			return 0, fmt.Errorf("%s was rewritten with fingerprint config %q by another process; open the database again", s.catalogPath, h.config.Name)
+		}
+		start = h.size
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+	end, err := readFrames(r, start, size, func([]byte) error { return nil })
+	if err == errTornBatch {
+		if err := file.Truncate(end); err != nil {
+			return 0, fmt.Errorf("failed to drop incomplete write at the end of %s: %v", s.catalogPath, err)
+		}
+		fmt.Printf("Warning: %s ended with an incomplete write, which was dropped\n", s.catalogPath)
+		return end, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", s.catalogPath, err)
+	}
+	return end, nil
+}
+
+// truncateFile cuts path down to size bytes and syncs it.
+func truncateFile(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,240 @@
+package matcher
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// randomHashes returns n hash occurrences derived from seed.
+func randomHashes(seed int64, n int) []fingerprint.Hash {
+	rng := rand.New(rand.NewSource(seed))
+	hashes := make([]fingerprint.Hash, n)
+	for i := range hashes {
+		hashes[i] = fingerprint.Hash{Hash: rng.Uint32(), AnchorTime: float64(i) / 10}
+	}
+	return hashes
+}
+
+// openFileStore opens the file store in dir with the default config saved.
+func openFileStore(t *testing.T, dir string) *FileStore {
+	t.Helper()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveConfig(fingerprint.DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func putSong(t *testing.T, s *FileStore, songID int) {
+	t.Helper()
+	if err := s.PutSong(Song{ID: songID, Title: "song"}, randomHashes(int64(songID), 50)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tearTail appends the first half of an entry to the catalog in dir, as a
+// writer that crashed mid-append would leave it.
+func tearTail(t *testing.T, dir string) {
+	t.Helper()
+	entry, err := appendEntry(nil, catalogEntry{op: entryPut, songID: 99, song: Song{ID: 99}, hashes: randomHashes(99, 50)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, catalogDBFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(entry[:len(entry)/2]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkSongs(t *testing.T, dir string, want ...int) {
+	t.Helper()
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	songs, _ := s.Songs()
+	if len(songs) != len(want) {
+		t.Fatalf("reloaded %d songs, want %v", len(songs), want)
+	}
+	for _, songID := range want {
+		if _, ok := songs[songID]; !ok {
+			t.Fatalf("song %d lost on reload; have %v", songID, songs)
+		}
+	}
+	stats, _ := s.Stats()
+	if stats.Entries != 50*len(want) {
+		t.Fatalf("reloaded %d hash occurrences, want %d", stats.Entries, 50*len(want))
+	}
+}
+
+// TestFileStoreAppendAfterTornTail has an open store append after another
+// writer left a torn entry at the end of the catalog. The torn entry must
+// be dropped rather than swallow the new one on the next load.
+func TestFileStoreAppendAfterTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+	putSong(t, s, 1)
+
+	tearTail(t, dir)
+	putSong(t, s, 2)
+	checkSongs(t, dir, 1, 2)
+
+	// Another store appends a song and then tears the tail; the first store
+	// must check the other's entry and drop only the torn one
+	other := openFileStore(t, dir)
+	putSong(t, other, 3)
+	tearTail(t, dir)
+	putSong(t, s, 4)
+	checkSongs(t, dir, 1, 2, 3, 4)
+}
+
+// TestFileStoreAppendAfterCorruption refuses to append after a damaged entry
+// that isn't at the end, since it can't tell where intact data resumes.
+func TestFileStoreAppendAfterCorruption(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+	putSong(t, s, 1)
+
+	other := openFileStore(t, dir)
+	putSong(t, other, 2)
+	putSong(t, other, 3)
+	path := filepath.Join(dir, catalogDBFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-700] ^= 0xff // inside song 2's entry
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutSong(Song{ID: 4}, randomHashes(4, 50)); err == nil {
+		t.Fatal("appended after a corrupt entry")
+	}
+}
+
+// TestFileStoreConfigMismatch has two stores with different configs share a
+// directory, as parallel --add runs with different presets would. Neither
+// may leave songs of both configs in one catalog.
+func TestFileStoreConfigMismatch(t *testing.T) {
+	speech, err := fingerprint.Preset("speech")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	a, _ := NewFileStore(dir)
+	b := openFileStore(t, dir)
+	putSong(t, b, 1)
+	if err := a.SaveConfig(speech); err == nil {
+		t.Fatal("changed the config of a catalog holding songs")
+	}
+
+	// Changing the config of an empty catalog is allowed, but a store still
+	// using the old config must not append to it
+	dir = t.TempDir()
+	a, _ = NewFileStore(dir)
+	if err := a.SaveConfig(speech); err != nil {
+		t.Fatal(err)
+	}
+	openFileStore(t, dir)
+	if err := a.PutSong(Song{ID: 1}, randomHashes(1, 50)); err == nil {
+		t.Fatal("appended a song made with another config")
+	}
+}
+
+// TestFileStoreUnmigratedLegacyFiles opens a directory holding version 1
+// hashes, which can't be migrated. Writing must fail rather than start a
+// catalog that hides the old songs.
+func TestFileStoreUnmigratedLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, hashesDBFile), make([]byte, 4*hashRecordSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileStore(dir)
+	if err == nil {
+		t.Fatal("loaded version 1 hashes")
+	}
+	if err := s.SaveConfig(fingerprint.DefaultConfig()); err == nil {
+		t.Fatal("saved a config next to unmigrated files")
+	}
+	if err := s.PutSong(Song{ID: 1}, randomHashes(1, 50)); err == nil {
+		t.Fatal("added a song next to unmigrated files")
+	}
+	if _, err := os.Stat(filepath.Join(dir, catalogDBFile)); !os.IsNotExist(err) {
+		t.Fatalf("catalog created next to unmigrated files: %v", err)
+	}
+}
+
+// TestFileStoreCorruptLength flips a bit in the length of the first entry.
+// That must be reported as corruption, not taken for a torn tail and
+// truncated along with every entry after it.
+func TestFileStoreCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+	for songID := 1; songID <= 3; songID++ {
+		putSong(t, s, songID)
+	}
+	path := filepath.Join(dir, catalogDBFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := readCatalogHeader(f, path)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bit := range []uint{0, 5, 12, 30} {
+		corrupt := append([]byte(nil), data...)
+		corrupt[h.size+int64(bit/8)] ^= 1 << (bit % 8)
+		if err := os.WriteFile(path, corrupt, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFileStore(dir); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("bit %d of the length: got error %v, want corruption", bit, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(data)) {
+			t.Fatalf("bit %d of the length: catalog truncated from %d to %d bytes", bit, len(data), info.Size())
+		}
+	}
+}
+
+// TestFileStoreZeroFilledTail appends zeros, as a crash after the file grew
+// but before its data reached the disk can leave, and expects them dropped.
+func TestFileStoreZeroFilledTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openFileStore(t, dir)
+	putSong(t, s, 1)
+	f, err := os.OpenFile(filepath.Join(dir, catalogDBFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 300))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSong(t, s, 2)
+	checkSongs(t, dir, 1, 2)
+}
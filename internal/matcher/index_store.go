@@ -0,0 +1,323 @@
+package matcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// indexFile is the file name of a compiled index inside the data directory.
+const indexFile = "fingerprints.idx"
+
+// A compiled index is an immutable file laid out as
+//
+//	header     32 bytes: magic "SHZI", format version, hash layout version,
+//	           prefix bits (uint32 each), record count, metadata length (uint64 each)
+//	metadata   JSON: fingerprint config, songs, unique hash count
+//	directory  (1<<prefixBits)+1 uint64 record indices; the records whose hash
+//	           starts with prefix p are [dir[p], dir[p+1])
+//	records    16 bytes each, sorted: hash (uint32), songID (uint32),
+//	           anchor time (float64)
+//
+// All integers are little-endian. Format 1 held only song names; such an
+// index has to be compiled again.
+const (
+	indexMagic         = "SHZI"
+	indexFormatVersion = 2
+	indexHeaderSize    = 32
+	indexPrefixBits    = 16
+	indexRecordSize    = 16
+)
+
+// ErrReadOnly is returned when writing to a read-only store.
+var ErrReadOnly = errors.New("store is read-only")
+
+type indexMeta struct {
+	Config       fingerprint.Config `json:"config"`
+	Songs        map[int]Song       `json:"songs"`
+	UniqueHashes int                `json:"uniqueHashes"`
+}
+
+// CompileIndex writes every entry of the database to a compiled index in
+// dir, replacing any previous one atomically. Query servers can then open
+// the index with BackendIndex.
+func (f *FingerprintDB) CompileIndex(dir string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	songs, err := f.store.Songs()
+	if err != nil {
+		return err
+	}
+	var records []indexRecord
+	err = f.store.ForEach(func(hash uint32, m Match) error {
+		records = append(records, indexRecord{hash: hash, songID: uint32(m.SongID), time: m.Timestamp})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		if a.songID != b.songID {
+			return a.songID < b.songID
+		}
+		return a.time < b.time
+	})
+
+	meta := indexMeta{Config: f.config, Songs: songs}
+	directory := make([]uint64, 1<<indexPrefixBits+1)
+	for i, r := range records {
+		if i == 0 || r.hash != records[i-1].hash {
+			meta.UniqueHashes++
+		}
+		directory[r.hash>>(32-indexPrefixBits)+1]++
+	}
+	for p := 1; p < len(directory); p++ {
+		directory[p] += directory[p-1]
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// bufio.Writer keeps the first write error and returns it from Flush
+	return writeFileAtomic(filepath.Join(dir, indexFile), func(w *bufio.Writer) error {
+		header := make([]byte, 0, indexHeaderSize)
+		header = append(header, indexMagic...)
+		header = binary.LittleEndian.AppendUint32(header, indexFormatVersion)
+		header = binary.LittleEndian.AppendUint32(header, fingerprint.HashVersion)
+		header = binary.LittleEndian.AppendUint32(header, indexPrefixBits)
+		header = binary.LittleEndian.AppendUint64(header, uint64(len(records)))
+		header = binary.LittleEndian.AppendUint64(header, uint64(len(metaJSON)))
+		w.Write(header)
+		w.Write(metaJSON)
+		var buf [indexRecordSize]byte
+		for _, d := range directory {
+			binary.LittleEndian.PutUint64(buf[:8], d)
+			w.Write(buf[:8])
+		}
+		for _, r := range records {
+			binary.LittleEndian.PutUint32(buf[0:], r.hash)
+			binary.LittleEndian.PutUint32(buf[4:], r.songID)
+			binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(r.time))
+			w.Write(buf[:])
+		}
+		return nil
+	})
+}
+
+type indexRecord struct {
+	hash   uint32
+	songID uint32
+	time   float64
+}
+
+// writeFileAtomic writes a file through a temp file in the same directory,
+// syncs it and renames it over path, so readers see the old file or the new
+// one but never a partial write.
+func writeFileAtomic(path string, write func(w *bufio.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// Persist the rename itself
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// IndexStore serves a compiled index straight from a memory-mapped file:
+// opening it reads only the header and metadata, and lookups binary-search
+// the records in place. It is read-only.
+type IndexStore struct {
+	data      []byte
+	unmap     func() error
+	meta      indexMeta
+	directory []byte
+	records   []byte
+	count     int
+}
+
+// NewIndexStore opens the compiled index in dir.
+func NewIndexStore(dir string) (*IndexStore, error) {
+	path := filepath.Join(dir, indexFile)
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseIndex(data)
+	if err != nil {
+		unmap()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	s.unmap = unmap
+	return s, nil
+}
+
+func parseIndex(data []byte) (*IndexStore, error) {
+	if len(data) < indexHeaderSize || string(data[:4]) != indexMagic {
+		return nil, errors.New("not a compiled index")
+	}
+	if v := binary.LittleEndian.Uint32(data[4:]); v != indexFormatVersion {
+		return nil, fmt.Errorf("unsupported index format v%d; compile the index again", v)
+	}
+	if v := binary.LittleEndian.Uint32(data[8:]); v != fingerprint.HashVersion {
+		return nil, fmt.Errorf("index uses hash layout v%d, but this build uses v%d", v, fingerprint.HashVersion)
+	}
+	if bits := binary.LittleEndian.Uint32(data[12:]); bits != indexPrefixBits {
+		return nil, fmt.Errorf("unsupported directory of %d prefix bits", bits)
+	}
+	count := binary.LittleEndian.Uint64(data[16:])
+	metaLen := binary.LittleEndian.Uint64(data[24:])
+
+	dirSize := uint64(1<<indexPrefixBits+1) * 8
+	// Bound the fields first so a corrupt count or length can't overflow
+	// the size check
+	if count > uint64(len(data))/indexRecordSize || metaLen > uint64(len(data)) {
+		return nil, errors.New("index header is corrupt")
+	}
+	want := uint64(indexHeaderSize) + metaLen + dirSize + count*indexRecordSize
+	if uint64(len(data)) != want {
+		return nil, fmt.Errorf("index is %d bytes, want %d (truncated or corrupt)", len(data), want)
+	}
+
+	s := &IndexStore{data: data, count: int(count)}
+	metaEnd := indexHeaderSize + metaLen
+	if err := json.Unmarshal(data[indexHeaderSize:metaEnd], &s.meta); err != nil {
+		return nil, fmt.Errorf("bad index metadata: %v", err)
+	}
+	s.directory = data[metaEnd : metaEnd+dirSize]
+	s.records = data[metaEnd+dirSize:]
+	if err := checkDirectory(s.directory, count); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkDirectory verifies that the directory entries are record offsets
+// running from 0 to count without decreasing, so Lookup stays within the
+// records whatever the file contains.
+func checkDirectory(directory []byte, count uint64) error {
+	prev := uint64(0)
+	for p := 0; p < len(directory); p += 8 {
+		off := binary.LittleEndian.Uint64(directory[p:])
+		if off < prev || off > count || (p == 0 && off != 0) {
+			return fmt.Errorf("index directory is corrupt at prefix %d", p/8)
+		}
+		prev = off
+	}
+	if prev != count {
+		return fmt.Errorf("index directory ends at record %d, want %d (corrupt)", prev, count)
+	}
+	return nil
+}
+
+func (s *IndexStore) record(i int) (hash uint32, m Match) {
+	r := s.records[i*indexRecordSize:]
+	return binary.LittleEndian.Uint32(r), Match{
+		SongID:    int(binary.LittleEndian.Uint32(r[4:])),
+		Timestamp: math.Float64frombits(binary.LittleEndian.Uint64(r[8:])),
+	}
+}
+
+func (s *IndexStore) Lookup(hash uint32) ([]Match, error) {
+	p := int(hash >> (32 - indexPrefixBits))
+	lo := int(binary.LittleEndian.Uint64(s.directory[p*8:]))
+	hi := int(binary.LittleEndian.Uint64(s.directory[(p+1)*8:]))
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		h, _ := s.record(lo + i)
+		return h >= hash
+	})
+	var matches []Match
+	for ; i < hi; i++ {
+		h, m := s.record(i)
+		if h != hash {
+			break
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+func (s *IndexStore) ForEach(fn func(hash uint32, m Match) error) error {
+	for i := 0; i < s.count; i++ {
+		if err := fn(s.record(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *IndexStore) Song(songID int) (Song, bool, error) {
+	song, ok := s.meta.Songs[songID]
+	return song, ok, nil
+}
+
+func (s *IndexStore) Songs() (map[int]Song, error) {
+	return copySongs(s.meta.Songs), nil
+}
+
+func (s *IndexStore) Stats() (Stats, error) {
+	return Stats{Songs: len(s.meta.Songs), UniqueHashes: s.meta.UniqueHashes, Entries: s.count}, nil
+}
+
+func (s *IndexStore) LoadConfig() (fingerprint.Config, bool, error) {
+	return s.meta.Config, true, nil
+}
+
+func (s *IndexStore) PutSong(song Song, hashes []fingerprint.Hash) error {
+	return ErrReadOnly
+}
+
+func (s *IndexStore) DeleteSong(songID int) error {
+	return ErrReadOnly
+}
+
+func (s *IndexStore) SaveConfig(cfg fingerprint.Config) error {
+	return ErrReadOnly
+}
+
+func (s *IndexStore) Close() error {
+	if s.unmap == nil {
+		return nil
+	}
+	err := s.unmap()
+	s.unmap = nil
+	return err
+}
@@ -0,0 +1,88 @@
+package matcher
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// compileTestIndex compiles a small database of random hashes and returns
+// the index file's contents and the hashes.
+func compileTestIndex(t *testing.T) ([]byte, []fingerprint.Hash) {
+	t.Helper()
+	db, err := NewDBWithStore(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	var all []fingerprint.Hash
+	for id := 1; id <= 3; id++ {
+		hashes := make([]fingerprint.Hash, 200)
+		for i := range hashes {
+			hashes[i] = fingerprint.Hash{Hash: rng.Uint32(), AnchorTime: float64(i) / 10}
+		}
+		if err := db.RegisterSong(Song{ID: id, Title: "song"}, hashes); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, hashes...)
+	}
+	dir := t.TempDir()
+	if err := db.CompileIndex(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, all
+}
+
+func TestParseIndexRejectsBadDirectory(t *testing.T) {
+	data, _ := compileTestIndex(t)
+	metaLen := binary.LittleEndian.Uint64(data[24:])
+	dirStart := indexHeaderSize + int(metaLen)
+	count := binary.LittleEndian.Uint64(data[16:])
+
+	for _, tc := range []struct {
+		name   string
+		prefix int
+		value  uint64
+	}{
+		{"past the records", 100, count + 1},
+		{"decreasing", 1 << (indexPrefixBits - 1), 0},
+		{"nonzero start", 0, 1},
+		{"short end", 1 << indexPrefixBits, count - 1},
+	} {
+		corrupt := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint64(corrupt[dirStart+8*tc.prefix:], tc.value)
+		if _, err := parseIndex(corrupt); err == nil || !strings.Contains(err.Error(), "directory") {
+			t.Errorf("%s: got error %v, want a corrupt directory error", tc.name, err)
+		}
+	}
+}
+
+// TestParseIndexBitFlips flips random bits anywhere in a compiled index.
+// Each result must either be rejected or serve lookups without panicking.
+func TestParseIndexBitFlips(t *testing.T) {
+	data, hashes := compileTestIndex(t)
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 2000; i++ {
+		corrupt := append([]byte(nil), data...)
+		pos := rng.Intn(len(corrupt))
+		corrupt[pos] ^= 1 << rng.Intn(8)
+		s, err := parseIndex(corrupt)
+		if err != nil {
+			continue
+		}
+		for _, h := range hashes {
+			if _, err := s.Lookup(h.Hash); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package matcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// Before the catalog, a file store kept its hashes in hashes.db, song names
+// in songs.json and the fingerprint config in config.json. These are only
+// read now, to migrate them into a catalog.
+//
+// hashes.db starts with the magic "SHZH" and the hash layout version 2
+// (uint32), followed by 16-byte records (hash uint32, songID uint32,
+// timestamp float64). Files without the magic hold version 1 hashes, which
+// can't be converted. A record whose timestamp is NaN is a tombstone that
+// discards every earlier record of its song.
+const (
+	hashesDBMagic    = "SHZH"
+	hashesDBVersion  = 2
+	hashesHeaderSize = 8
+	hashRecordSize   = 16
+)
+
+// hasLegacyFiles reports whether dir holds a database from before the catalog.
+func hasLegacyFiles(dir string) bool {
+	for _, name := range []string{hashesDBFile, songsDBFile, configDBFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readLegacyFiles reads a database from before the catalog in dir and
+// returns its config and the live entry of every song in songs.json.
+func readLegacyFiles(dir string) (fingerprint.Config, bool, map[int]catalogEntry, error) {
+	cfg, hasConfig, err := readLegacyConfig(filepath.Join(dir, configDBFile))
+	if err != nil {
+		return cfg, false, nil, fmt.Errorf("failed to load fingerprint config: %v", err)
+	}
+	songs, err := readLegacySongs(filepath.Join(dir, songsDBFile))
+	if err != nil {
+		return cfg, false, nil, fmt.Errorf("failed to load songs: %v", err)
+	}
+
+	live := make(map[int]catalogEntry, len(songs))
+	for songID, name := range songs {
+		live[songID] = catalogEntry{op: entryPut, songID: songID, song: Song{ID: songID, Title: name}}
+	}
+	path := filepath.Join(dir, hashesDBFile)
+	err = readLegacyHashes(path, func(hash uint32, songID int, timestamp float64) {
+		e, ok := live[songID]
+		if !ok {
+			return // Left by an interrupted add or a delete
+		}
+		if math.IsNaN(timestamp) {
+			e.hashes = nil
+		} else {
+			e.hashes = append(e.hashes, fingerprint.Hash{Hash: hash, AnchorTime: timestamp})
+		}
+		live[songID] = e
+	})
+	if err != nil {
+		return cfg, false, nil, fmt.Errorf("failed to load hashes: %v", err)
+	}
+	return cfg, hasConfig, live, nil
+}
+
+// readLegacyHashes calls fn for every complete record of the hashes.db at
+// path, ignoring a torn write at its end.
+func readLegacyHashes(path string, fn func(hash uint32, songID int, timestamp float64)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	header := make([]byte, hashesHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil // Empty file
+	}
+	if n < hashesHeaderSize || string(header[:len(hashesDBMagic)]) != hashesDBMagic {
+		// Version 1 hashes lost information when fields overlapped, so they
+		// cannot be converted; the songs have to be fingerprinted again
+		return fmt.Errorf("%s uses hash layout v1, which is incompatible with v%d; remove the data directory and re-add the songs", path, fingerprint.HashVersion)
+	}
+	if version := binary.LittleEndian.Uint32(header[len(hashesDBMagic):]); version != hashesDBVersion {
+		return fmt.Errorf("%s has unknown format v%d", path, version)
+	}
+
+	record := make([]byte, hashRecordSize)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		hash := binary.LittleEndian.Uint32(record[0:])
+		songID := normalizeSongID(int(int32(binary.LittleEndian.Uint32(record[4:]))))
+		fn(hash, songID, math.Float64frombits(binary.LittleEndian.Uint64(record[8:])))
+	}
+}
+
+// readLegacyConfig reads config.json, if present.
+func readLegacyConfig(path string) (fingerprint.Config, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fingerprint.Config{}, false, nil
+		}
+		return fingerprint.Config{}, false, err
+	}
+	var cfg fingerprint.Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fingerprint.Config{}, false, err
+	}
+	return cfg, true, nil
+}
+
+// readLegacySongs reads songs.json; a missing file holds no songs.
+func readLegacySongs(path string) (map[int]string, error) {
+	songs := make(map[int]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return songs, nil
+		}
+		return nil, err
+	}
+	// JSON keys are strings, so unmarshal to string map first
+	songsStr := make(map[string]string)
+	if err := json.Unmarshal(data, &songsStr); err != nil {
+		return nil, err
+	}
+	// Convert string keys to int keys
+	for k, v := range songsStr {
+		var id int
+		fmt.Sscanf(k, "%d", &id)
+		// Normalize to positive ID
+		songs[normalizeSongID(id)] = v
+	}
+	return songs, nil
+}
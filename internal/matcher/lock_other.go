@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package matcher
+
+import "errors"
+
+// lockFile fails: without a cross-process lock, concurrent writers could
+// interleave entries, so file stores are read-only here.
+func lockFile(path string) (unlock func(), err error) {
+	return nil, errors.New("file locking is not supported on this platform")
+}
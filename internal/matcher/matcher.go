@@ -1,73 +1,293 @@
 package matcher
 
 import (
-	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"shazam-go/internal/fingerprint"
 )
 
 const (
-	hashesDBFile = "data/hashes.db"
-	songsDBFile  = "data/songs.json"
+	// DefaultDataDir is used when Options.DataDir is empty, relative to the
+	// working directory.
+	DefaultDataDir = "data"
+
+	catalogDBFile = "catalog.db"
+	lockFileName  = "LOCK"
+	// Files of databases from before the catalog, read only to migrate them
+	hashesDBFile = "hashes.db"
+	songsDBFile  = "songs.json"
+	configDBFile = "config.json"
 	offsetTolerance = 0.5 
 )
 
+// Options configures where and how a FingerprintDB is stored.
+type Options struct {
+	// DataDir holds the database files. If it is set explicitly, any
+	// problem reading the database is an error; with the default, a
+	// missing or unreadable database only produces a warning.
+	DataDir string
+	// Create allows an explicit DataDir that doesn't exist yet to be created.
+	Create bool
+	// Backend selects the storage backend: BackendFile, BackendBolt or
+	// BackendIndex. If empty, an existing bolt database in DataDir is used,
+	// otherwise files. A compiled index is only used when asked for.
+	Backend string
+}
+
+// Storage backends
+const (
+	// BackendFile loads data/catalog.db into memory (FileStore)
+	BackendFile = "file"
+	// BackendBolt queries an embedded on-disk index (BoltStore)
+	BackendBolt = "bolt"
+	// BackendIndex serves a compiled, read-only index (IndexStore)
+	BackendIndex = "index"
+)
+
+var (
+	// ErrSongNotFound is returned when changing a song that isn't in the database.
+	ErrSongNotFound = errors.New("song not found")
+	// ErrNoCompaction is returned by Compact for backends that reuse freed space
+	// themselves.
+	ErrNoCompaction = errors.New("storage backend does not need compaction")
+)
+
 type Match struct{
 	SongID int
 	Timestamp float64
 }
 
 type FingerprintDB struct{
-	db map[uint32][]Match
+	store Store
 	mu sync.RWMutex
-	songs map[int]string 
+	// config is the fingerprint configuration every song was fingerprinted with
+	config fingerprint.Config
+	configSaved bool
 }
 
-func NewDB() *FingerprintDB{
-	db := &FingerprintDB{
-		db: make(map[uint32][]Match),
-		songs: make(map[int]string),
+// NewDB opens the file-backed database described by opts
+func NewDB(opts Options) (*FingerprintDB, error) {
+	dir := opts.DataDir
+	explicit := dir != ""
+	if !explicit {
+		dir = DefaultDataDir
+	}
+	if explicit {
+		info, err := os.Stat(dir)
+		switch {
+		case os.IsNotExist(err) && opts.Create:
+		case os.IsNotExist(err):
+			return nil, fmt.Errorf("database directory %s does not exist", dir)
+		case err != nil:
+			return nil, fmt.Errorf("cannot read database directory: %v", err)
+		case !info.IsDir():
+			return nil, fmt.Errorf("database path %s is not a directory", dir)
+		}
 	}
 
-	if err := db.LoadFromFiles(); err != nil {
-		fmt.Printf("Warning: Could not load database files: %v (starting with empty database)\n", err)
+	backend := opts.Backend
+	if backend == "" {
+		backend = BackendFile
+		if _, err := os.Stat(filepath.Join(dir, boltDBFile)); err == nil {
+			backend = BackendBolt
+		}
+	}
+	var store Store
+	switch backend {
+	case BackendFile:
+		fileStore, err := NewFileStore(dir)
+		if err != nil {
+			if explicit {
+				return nil, fmt.Errorf("cannot read database in %s: %v", dir, err)
+			}
+			fmt.Printf("Warning: Could not load database files: %v (starting with empty database)\n", err)
+		}
+		store = fileStore
+	case BackendBolt:
+		// An unreadable bolt file can't be written either, so this is
+		// always an error
+		boltStore, err := NewBoltStore(dir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open database in %s: %v", dir, err)
+		}
+		store = boltStore
+	case BackendIndex:
+		indexStore, err := NewIndexStore(dir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open compiled index in %s: %v", dir, err)
+		}
+		store = indexStore
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (want %s, %s or %s)", backend, BackendFile, BackendBolt, BackendIndex)
 	}
-	return db
+
+	db, err := NewDBWithStore(store)
+	if err != nil {
+		if explicit {
+			store.Close()
+			return nil, fmt.Errorf("cannot read database in %s: %v", dir, err)
+		}
+		fmt.Printf("Warning: Could not load fingerprint config: %v (using default)\n", err)
+	}
+	return db, nil
+}
+
+// NewDBWithStore returns a database backed by store, using the fingerprint
+// config recorded in it. If that config can't be read or is invalid, the
+// error is returned with a database that uses the default config.
+func NewDBWithStore(store Store) (*FingerprintDB, error) {
+	db := &FingerprintDB{
+		store: store,
+		config: fingerprint.DefaultConfig(),
+	}
+	cfg, ok, err := store.LoadConfig()
+	if err == nil && ok {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		return db, fmt.Errorf("failed to load fingerprint config: %v", err)
+	}
+	if ok {
+		db.config = cfg
+		db.configSaved = true
+	}
+	return db, nil
 }
 
-func (f *FingerprintDB) RegisterSong(songID int, songName string, hashes map[uint32]float64) error {
+// Store returns the storage backend of the database.
+func (f *FingerprintDB) Store() Store {
+	return f.store
+}
+
+// Close closes the storage backend.
+func (f *FingerprintDB) Close() error {
+	return f.store.Close()
+}
+
+// RegisterSong adds a song to the database. Registering an ID that is
+// already present replaces that song, so adding the same file twice does not
+// duplicate its hashes. A song without an IngestTime is stamped with the
+// current time.
+func (f *FingerprintDB) RegisterSong(song Song, hashes []fingerprint.Hash) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	song.ID = normalizeSongID(song.ID)
+	return f.putSong(song, hashes)
+}
+
+// ReplaceSong replaces the metadata and hashes of a song already in the
+// database, e.g. after re-fingerprinting it. It returns ErrSongNotFound if
+// the song isn't there.
+func (f *FingerprintDB) ReplaceSong(song Song, hashes []fingerprint.Hash) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	
-	f.songs[songID] = songName
+	song.ID = normalizeSongID(song.ID)
+	if err := f.checkSongExists(song.ID); err != nil {
+		return err
+	}
+	return f.putSong(song, hashes)
+}
+
+// DeleteSong removes a song and its hashes from the database. It returns
+// ErrSongNotFound if the song isn't there.
+func (f *FingerprintDB) DeleteSong(songID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	
-	for hash, timestamp := range hashes {
-		match := Match{
-			SongID:    songID,
-			Timestamp: timestamp,
+	songID = normalizeSongID(songID)
+	if err := f.checkSongExists(songID); err != nil {
+		return err
+	}
+	return f.store.DeleteSong(songID)
+}
+
+// Compact drops the records of replaced and deleted songs from the
+// database files. It is safe to run while the database serves lookups,
+// including from other processes that have it loaded.
+func (f *FingerprintDB) Compact() (CompactStats, error) {
+	c, ok := f.store.(Compacter)
+	if !ok {
+		return CompactStats{}, ErrNoCompaction
+	}
+	return c.Compact()
+}
+
+func (f *FingerprintDB) putSong(song Song, hashes []fingerprint.Hash) error {
+	if !f.configSaved {
+		if err := f.store.SaveConfig(f.config); err != nil {
+			return fmt.Errorf("failed to save fingerprint config: %v", err)
 		}
-		f.db[hash] = append(f.db[hash], match)
+		f.configSaved = true
 	}
-	
-	if err := f.saveSongMetadata(songID, songName); err != nil {
-		return fmt.Errorf("failed to save song metadata: %v", err)
+	if song.IngestTime.IsZero() {
+		song.IngestTime = time.Now().UTC()
 	}
-	if err := f.appendHashesToFile(songID, hashes); err != nil {
-		return fmt.Errorf("failed to save hashes: %v", err)
+	return f.store.PutSong(song, hashes)
+}
+
+func (f *FingerprintDB) checkSongExists(songID int) error {
+	_, ok, err := f.store.Song(songID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrSongNotFound, songID)
 	}
-	
 	return nil
 }
 
-func (f *FingerprintDB) GetSongName(songID int) string {
+// Config returns the fingerprint configuration the database's songs were
+// fingerprinted with. Queries must be fingerprinted the same way.
+// Databases created before the config was recorded used the default preset.
+func (f *FingerprintDB) Config() fingerprint.Config {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	positiveID := normalizeSongID(songID)
-	return f.songs[positiveID]
+	return f.config
+}
+
+// SetConfig selects the fingerprint configuration for the database. It fails
+// if the database already holds songs fingerprinted with a different config.
+func (f *FingerprintDB) SetConfig(cfg fingerprint.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	
+	if cfg == f.config {
+		return nil
+	}
+	stats, err := f.store.Stats()
+	if err != nil {
+		return err
+	}
+	if stats.Songs > 0 {
+		return fmt.Errorf("database was built with fingerprint config %q, not %q; queries and new songs must use the same config", f.config.Name, cfg.Name)
+	}
+	f.config = cfg
+	f.configSaved = false
+	return nil
+}
+
+// GetSong returns the song with the given ID; ok is false if it isn't in
+// the database.
+func (f *FingerprintDB) GetSong(songID int) (song Song, ok bool) {
+	song, ok, err := f.store.Song(normalizeSongID(songID))
+	if err != nil {
+		return Song{}, false
+	}
+	return song, ok
+}
+
+func (f *FingerprintDB) GetSongName(songID int) string {
+	song, _ := f.GetSong(songID)
+	return song.Name()
 }
 
 func normalizeSongID(songID int) int {
@@ -81,33 +301,31 @@ func normalizeSongID(songID int) int {
 }
 
 func (f *FingerprintDB) GetStats() (totalHashes int, totalMatches int) {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-	
-	totalHashes = len(f.db)
-	for _, matches := range f.db {
-		totalMatches += len(matches)
+	stats, err := f.store.Stats()
+	if err != nil {
+		return 0, 0
 	}
-	return totalHashes, totalMatches
+	return stats.UniqueHashes, stats.Entries
 }
 
 // GetMatchesForHash returns all matches for a given hash (for debugging)
 func (f *FingerprintDB) GetMatchesForHash(hash uint32) []Match {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-	return f.db[hash]
+	matches, _ := f.store.Lookup(hash)
+	return matches
 }
 
 type MatchResult struct{
 	SongID int
 	Confidence float64
 	SongName string
+	// Song is everything recorded about the matched song
+	Song Song
 	MatchCount int
 	TotalHashes int
 }
 
 // Match finds the best matching song for the given query hashes
-func (f *FingerprintDB) Match(queryHashes map[uint32]float64) MatchResult {
+func (f *FingerprintDB) Match(queryHashes []fingerprint.Hash) MatchResult {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	
@@ -117,7 +335,7 @@ func (f *FingerprintDB) Match(queryHashes map[uint32]float64) MatchResult {
 		return MatchResult{SongID: -1, Confidence: 0.0, MatchCount: 0, TotalHashes: 0}
 	}
 	
-	if len(f.db) == 0 {
+	if stats, err := f.store.Stats(); err == nil && stats.Entries == 0 {
 		fmt.Println("matcher: Database is empty")
 		return MatchResult{SongID: -1, Confidence: 0.0, MatchCount: 0, TotalHashes: len(queryHashes)}
 	}
@@ -131,13 +349,17 @@ func (f *FingerprintDB) Match(queryHashes map[uint32]float64) MatchResult {
 	}
 	offsetMatches := make(map[offsetKey]int)
 	
-	// For each query hash, find matches in database
-	for queryHash, queryTime := range queryHashes {
-		dbMatches := f.db[queryHash]
+	// For each query hash occurrence, find every occurrence in the database
+	for _, query := range queryHashes {
+		dbMatches, err := f.store.Lookup(query.Hash)
+		if err != nil {
+			fmt.Printf("matcher: Lookup failed: %v\n", err)
+			return MatchResult{SongID: -1, Confidence: 0.0, MatchCount: 0, TotalHashes: len(queryHashes)}
+		}
 		
 		// For each database match, calculate time offset and bucket it
 		for _, dbMatch := range dbMatches {
-			offset := queryTime - dbMatch.Timestamp
+			offset := query.AnchorTime - dbMatch.Timestamp
 			// Round offset to nearest bucket (e.g., 0.5s buckets)
 			offsetBucket := int(offset / offsetTolerance)
 			
@@ -168,9 +390,13 @@ func (f *FingerprintDB) Match(queryHashes map[uint32]float64) MatchResult {
 	// Calculate confidence: matches / total query hashes
 	confidence := float64(bestCount) / float64(len(queryHashes))
 	
-	// Get song name (normalize ID to positive for lookup)
+	// Get song metadata (normalize ID to positive for lookup)
 	positiveID := normalizeSongID(bestKey.songID)
-	songName := f.songs[positiveID]
+	song, ok := f.GetSong(positiveID)
+	if !ok {
+		song.ID = positiveID
+	}
+	songName := song.Name()
 	if songName == "" {
 		songName = "Unknown"
 	}
@@ -182,166 +408,8 @@ func (f *FingerprintDB) Match(queryHashes map[uint32]float64) MatchResult {
 		SongID:     positiveID,
 		Confidence: confidence,
 		SongName:   songName,
+		Song:       song,
 		MatchCount: bestCount,
 		TotalHashes: len(queryHashes),
 	}
 }
-
-// LoadFromFiles loads database from disk
-func (f *FingerprintDB) LoadFromFiles() error {
-	if err := f.loadSongsFromFile(); err != nil {
-		return fmt.Errorf("failed to load songs: %v", err)
-	}
-	if err := f.loadHashesFromFile(); err != nil {
-		return fmt.Errorf("failed to load hashes: %v", err)
-	}
-	return nil
-}
-
-// saveSongMetadata saves song metadata to JSON file
-func (f *FingerprintDB) saveSongMetadata(songID int, songName string) error {
-	// Ensure data directory exists
-	dir := filepath.Dir(songsDBFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-	
-	// Load existing songs (JSON keys are strings)
-	songsStr := make(map[string]string)
-	if data, err := os.ReadFile(songsDBFile); err == nil {
-		json.Unmarshal(data, &songsStr)
-	}
-	
-	// Convert to int map for internal use
-	songs := make(map[int]string)
-	for k, v := range songsStr {
-		var id int
-		fmt.Sscanf(k, "%d", &id)
-		songs[id] = v
-	}
-	
-	// Add/update song (ensure positive ID)
-	positiveID := normalizeSongID(songID)
-	songs[positiveID] = songName
-	
-	// Convert back to string keys for JSON
-	songsStr = make(map[string]string)
-	for k, v := range songs {
-		songsStr[fmt.Sprintf("%d", k)] = v
-	}
-	
-	// Save to file
-	data, err := json.MarshalIndent(songsStr, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(songsDBFile, data, 0644)
-}
-
-// loadSongsFromFile loads song metadata from JSON file
-func (f *FingerprintDB) loadSongsFromFile() error {
-	data, err := os.ReadFile(songsDBFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil 
-		}
-		return err
-	}
-	// JSON keys are strings, so unmarshal to string map first
-	songsStr := make(map[string]string)
-	if err := json.Unmarshal(data, &songsStr); err != nil {
-		return err
-	}
-	// Convert string keys to int keys
-	for k, v := range songsStr {
-		var id int
-		fmt.Sscanf(k, "%d", &id)
-		// Normalize to positive ID
-		positiveID := normalizeSongID(id)
-		f.songs[positiveID] = v
-	}
-	return nil
-}
-
-// appendHashesToFile appends hashes to binary file
-func (f *FingerprintDB) appendHashesToFile(songID int, hashes map[uint32]float64) error {
-	// Ensure data directory exists
-	dir := filepath.Dir(hashesDBFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-	
-	file, err := os.OpenFile(hashesDBFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	
-	// Normalize songID to positive before storing
-	positiveID := normalizeSongID(songID)
-	
-	// Write each hash entry
-	for hash, timestamp := range hashes {
-		// Format: hash (4 bytes) + songID (4 bytes) + timestamp (8 bytes)
-		if err := binary.Write(file, binary.LittleEndian, hash); err != nil {
-			return err
-		}
-		if err := binary.Write(file, binary.LittleEndian, int32(positiveID)); err != nil {
-			return err
-		}
-		if err := binary.Write(file, binary.LittleEndian, timestamp); err != nil {
-			return err
-		}
-	}
-	
-	return nil
-}
-
-// loadHashesFromFile loads all hashes from binary file
-func (f *FingerprintDB) loadHashesFromFile() error {
-	file, err := os.Open(hashesDBFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // File doesn't exist yet, that's okay
-		}
-		return err
-	}
-	defer file.Close()
-	
-	// Read entries until EOF
-	for {
-		var hash uint32
-		var songID int32
-		var timestamp float64
-		
-		// Try to read hash
-		if err := binary.Read(file, binary.LittleEndian, &hash); err != nil {
-			if err == io.EOF {
-				break // End of file
-			}
-			return err
-		}
-		
-		// Read songID
-		if err := binary.Read(file, binary.LittleEndian, &songID); err != nil {
-			return err
-		}
-		
-		// Read timestamp
-		if err := binary.Read(file, binary.LittleEndian, &timestamp); err != nil {
-			return err
-		}
-		
-		// Normalize songID to positive
-		positiveID := normalizeSongID(int(songID))
-		
-		// Store in memory
-		match := Match{
-			SongID:    positiveID,
-			Timestamp: timestamp,
-		}
-		f.db[hash] = append(f.db[hash], match)
-	}
-	
-	return nil
-}
@@ -0,0 +1,41 @@
+package matcher
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// Song is what the database records about a song besides its hashes. Only
+// ID is required; the other fields are filled in from the file's tags, the
+// command line or the upload form when known.
+type Song struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	// ISRC is the International Standard Recording Code of the recording
+	ISRC string `json:"isrc,omitempty"`
+	// Duration is the length of the audio in seconds, 0 if unknown
+	Duration float64 `json:"duration,omitempty"`
+	// SampleRate is the sample rate of the source file, before resampling
+	SampleRate int `json:"sampleRate,omitempty"`
+	// SourcePath is the file the song was fingerprinted from
+	SourcePath string `json:"sourcePath,omitempty"`
+	// Checksum is the hex SHA-256 of the source file's contents
+	Checksum string `json:"checksum,omitempty"`
+	// IngestTime is when the song was added; zero for songs added before it
+	// was recorded
+	IngestTime time.Time `json:"ingestTime"`
+}
+
+// Name returns the song's title, or the name of its source file if it has
+// none.
+func (s Song) Name() string {
+	if s.Title != "" {
+		return s.Title
+	}
+	if s.SourcePath != "" {
+		return filepath.Base(s.SourcePath)
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+package matcher
+
+import (
+	"sync"
+
+	"shazam-go/internal/fingerprint"
+)
+
+// Store holds registered songs and the index from hash to the places it
+// occurs. FingerprintDB does the matching on top of any Store.
+//
+// Stores must be safe for concurrent use.
+type Store interface {
+	// PutSong records a song and every occurrence of its hashes. A song
+	// already stored with the same ID is replaced, so putting the same song
+	// twice leaves a single copy.
+	PutSong(song Song, hashes []fingerprint.Hash) error
+	// Lookup returns every occurrence of hash. The slice must not be modified.
+	Lookup(hash uint32) ([]Match, error)
+	// ForEach calls fn for every occurrence of every hash, in no particular
+	// order, stopping at the first error.
+	ForEach(fn func(hash uint32, m Match) error) error
+	// Song returns the song with the given ID; ok is false if it isn't
+	// stored.
+	Song(songID int) (song Song, ok bool, err error)
+	// Songs returns all songs, keyed by song ID.
+	Songs() (map[int]Song, error)
+	// DeleteSong removes a song and all of its hashes. Deleting a song that
+	// isn't stored does nothing.
+	DeleteSong(songID int) error
+	// Stats summarizes the store's contents.
+	Stats() (Stats, error)
+	// LoadConfig returns the fingerprint config the stored hashes were made
+	// with; ok is false if none has been saved.
+	LoadConfig() (cfg fingerprint.Config, ok bool, err error)
+	// SaveConfig records the fingerprint config.
+	SaveConfig(cfg fingerprint.Config) error
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// Stats describes the contents of a Store.
+type Stats struct {
+	Songs        int
+	UniqueHashes int
+	// Entries is the number of (hash, song, time) occurrences.
+	Entries int
+}
+
+// Compacter is implemented by stores whose files keep the records of
+// replaced and deleted songs until they are compacted.
+type Compacter interface {
+	// Compact rewrites the store's files to hold only live songs.
+	Compact() (CompactStats, error)
+}
+
+// CompactStats reports the size of the compacted files.
+type CompactStats struct {
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+// MemoryStore is a Store that lives only in memory.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	index     map[uint32][]Match
+	songs     map[int]Song
+	config    fingerprint.Config
+	hasConfig bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		index: make(map[uint32][]Match),
+		songs: make(map[int]Song),
+	}
+}
+
+func (m *MemoryStore) PutSong(song Song, hashes []fingerprint.Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.songs[song.ID]; ok {
+		removeFromIndex(m.index, song.ID)
+	}
+	m.songs[song.ID] = song
+	addToIndex(m.index, song.ID, hashes)
+	return nil
+}
+
+func (m *MemoryStore) Lookup(hash uint32) ([]Match, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.index[hash], nil
+}
+
+func (m *MemoryStore) ForEach(fn func(hash uint32, match Match) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return forEachInIndex(m.index, fn)
+}
+
+func (m *MemoryStore) Song(songID int) (Song, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	song, ok := m.songs[songID]
+	return song, ok, nil
+}
+
+func (m *MemoryStore) Songs() (map[int]Song, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copySongs(m.songs), nil
+}
+
+func (m *MemoryStore) DeleteSong(songID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.songs[songID]; !ok {
+		return nil
+	}
+	delete(m.songs, songID)
+	removeFromIndex(m.index, songID)
+	return nil
+}
+
+func (m *MemoryStore) Stats() (Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return indexStats(m.index, m.songs), nil
+}
+
+func (m *MemoryStore) LoadConfig() (fingerprint.Config, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.config, m.hasConfig, nil
+}
+
+func (m *MemoryStore) SaveConfig(cfg fingerprint.Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config, m.hasConfig = cfg, true
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// addToIndex adds every occurrence of a song's hashes to index.
+func addToIndex(index map[uint32][]Match, songID int, hashes []fingerprint.Hash) {
+	for _, h := range hashes {
+		index[h.Hash] = append(index[h.Hash], Match{
+			SongID:    songID,
+			Timestamp: h.AnchorTime,
+		})
+	}
+}
+
+// removeFromIndex drops every occurrence belonging to songID from index.
+// Slices are replaced rather than filtered in place, since Lookup callers
+// may still be reading them.
+func removeFromIndex(index map[uint32][]Match, songID int) {
+	for hash, matches := range index {
+		var kept []Match
+		found := false
+		for _, m := range matches {
+			if m.SongID == songID {
+				found = true
+			} else {
+				kept = append(kept, m)
+			}
+		}
+		if !found {
+			continue
+		}
+		if len(kept) == 0 {
+			delete(index, hash)
+		} else {
+			index[hash] = kept
+		}
+	}
+}
+
+func forEachInIndex(index map[uint32][]Match, fn func(hash uint32, m Match) error) error {
+	for hash, matches := range index {
+		for _, m := range matches {
+			if err := fn(hash, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func indexStats(index map[uint32][]Match, songs map[int]Song) Stats {
+	stats := Stats{Songs: len(songs), UniqueHashes: len(index)}
+	for _, matches := range index {
+		stats.Entries += len(matches)
+	}
+	return stats
+}
+
+func copySongs(songs map[int]Song) map[int]Song {
+	out := make(map[int]Song, len(songs))
+	for id, song := range songs {
+		out[id] = song
+	}
+	return out
+}